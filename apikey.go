@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+var ErrInvalidScope = errors.New("unknown scope")
+
+// apiKeyUsageInterval bounds how often the last use of a key is written.
+const apiKeyUsageInterval = time.Minute
+
+// APIKey lets services call ad-manager without a user session. Only the
+// SHA-256 of the key is stored; the key itself is shown once, when created
+// or rotated. Keys read "am_{prefix}_{secret}".
+type APIKey struct {
+	IdApiKey uint   `json:"id" gorm:"primaryKey"`
+	Name     string `json:"name"`
+	// Prefix identifies the key, and is shown in place of it.
+	Prefix string `json:"prefix" gorm:"uniqueIndex"`
+	Hash   string `json:"-"`
+	// Scopes are the permissions of the key, named as in Policy. Roles do
+	// not apply to keys.
+	Scopes    []string `json:"scopes" gorm:"-"`
+	ScopeList string   `json:"-" gorm:"column:scopes"`
+	// CreatedBy is the subject of the caller who created the key.
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	// The key replaced by the last rotation stays valid until
+	// PreviousExpiresAt, so callers can switch over.
+	PreviousPrefix    string     `json:"-" gorm:"index"`
+	PreviousHash      string     `json:"-"`
+	PreviousExpiresAt *time.Time `json:"-"`
+}
+
+func (APIKey) TableName() string {
+	return "t_api_key"
+}
+
+func (key *APIKey) BeforeSave(tx *gorm.DB) error {
+	key.ScopeList = strings.Join(key.Scopes, ",")
+	return nil
+}
+
+func (key *APIKey) AfterFind(tx *gorm.DB) error {
+	key.Scopes = []string{}
+	if key.ScopeList != "" {
+		key.Scopes = strings.Split(key.ScopeList, ",")
+	}
+	return nil
+}
+
+// validScope tells whether scope is a permission Policy can grant.
+func validScope(scope string) bool {
+	if scope == "*" || scope == ActionAdCreate+":any" {
+		return true
+	}
+	for _, action := range []string{ActionAdCreate, ActionAdWrite, ActionAdDelete, ActionPhotoWrite, ActionPhotoDelete,
+		ActionUsageRead, ActionJobRead, ActionJobReplay, ActionAPIKeyManage} {
+		if scopedActions[action] && (scope == action+":own" || scope == action+":any") ||
+			!scopedActions[action] && scope == action {
+			return true
+		}
+	}
+	return false
+}
+
+// newAPIKeySecret returns a new key and its prefix.
+func newAPIKeySecret() (string, string, error) {
+	prefix := make([]byte, 6)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(prefix); err != nil {
+		return "", "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	encodedPrefix := hex.EncodeToString(prefix)
+	return "am_" + encodedPrefix + "_" + base64.RawURLEncoding.EncodeToString(secret), encodedPrefix, nil
+}
+
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// CreateAPIKey stores a key with the name, scopes and expiry of key, and
+// returns it along with the key itself. Keys are only granted scopes the
+// caller holds.
+func (s adService) CreateAPIKey(ctx context.Context, key APIKey) (*APIKey, string, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "CreateAPIKey request received", "context", fmt.Sprintf("\"name\":%q,\"scopes\":%q", key.Name, key.Scopes))
+
+	if key.Name == "" || len(key.Scopes) == 0 {
+		level.Error(logger).Log("context", "CreateAPIKey", "msg", ErrMissingFields)
+		return nil, "", ErrMissingFields
+	}
+	for _, scope := range key.Scopes {
+		if !validScope(scope) {
+			level.Error(logger).Log("context", "CreateAPIKey", "msg", ErrInvalidScope, "scope", scope)
+			return nil, "", ErrInvalidScope
+		}
+		if g, ok := grantFromContext(ctx); !ok || !g.covers(scope) {
+			level.Error(logger).Log("context", "CreateAPIKey", "msg", ErrForbidden, "scope", scope)
+			return nil, "", ErrForbidden
+		}
+	}
+	secret, prefix, err := newAPIKeySecret()
+	if err != nil {
+		level.Error(logger).Log("context", "CreateAPIKey", "msg", err)
+		return nil, "", err
+	}
+	created := APIKey{
+		Name:      key.Name,
+		Prefix:    prefix,
+		Hash:      hashAPIKey(secret),
+		Scopes:    key.Scopes,
+		ExpiresAt: key.ExpiresAt,
+	}
+	if principal, ok := PrincipalFromContext(ctx); ok {
+		created.CreatedBy = principal.Subject
+	}
+	if result := s.db.Create(&created); result.Error != nil {
+		level.Error(logger).Log("context", "CreateAPIKey", "msg", result.Error)
+		return nil, "", result.Error
+	}
+	markPrivileged(ctx, fmt.Sprintf("apikey/%d", created.IdApiKey))
+	return &created, secret, nil
+}
+
+func (s adService) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "ListAPIKeys request received")
+
+	keys := []APIKey{}
+	if result := s.db.Order("id_api_key").Find(&keys); result.Error != nil {
+		level.Error(logger).Log("context", "ListAPIKeys", "msg", result.Error)
+		return nil, result.Error
+	}
+	return keys, nil
+}
+
+// RotateAPIKey replaces a key with a new one, which it returns. The
+// replaced key stays valid for ServiceConfig.APIKeyRotationGrace. Only
+// callers holding every scope of the key may rotate it.
+func (s adService) RotateAPIKey(ctx context.Context, id uint) (*APIKey, string, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "RotateAPIKey request received", "context", fmt.Sprintf("\"id\":%d", id))
+
+	markPrivileged(ctx, fmt.Sprintf("apikey/%d", id))
+	key, err := s.manageableAPIKey(ctx, id)
+	if err != nil {
+		level.Error(logger).Log("context", "RotateAPIKey", "msg", err)
+		return nil, "", err
+	}
+	secret, prefix, err := newAPIKeySecret()
+	if err != nil {
+		level.Error(logger).Log("context", "RotateAPIKey", "msg", err)
+		return nil, "", err
+	}
+	now := time.Now()
+	previousExpiresAt := now.Add(s.keyRotationGrace)
+	// The key is only replaced if it was not rotated or revoked since it
+	// was read.
+	result := s.db.Model(&APIKey{}).Where("id_api_key = ? AND prefix = ? AND revoked_at IS NULL", id, key.Prefix).Updates(map[string]interface{}{
+		"previous_prefix":     key.Prefix,
+		"previous_hash":       key.Hash,
+		"previous_expires_at": previousExpiresAt,
+		"prefix":              prefix,
+		"hash":                hashAPIKey(secret),
+		"rotated_at":          now,
+	})
+	if result.Error != nil {
+		level.Error(logger).Log("context", "RotateAPIKey", "msg", result.Error)
+		return nil, "", result.Error
+	}
+	if result.RowsAffected < 1 {
+		level.Error(logger).Log("context", "RotateAPIKey", "msg", ErrNotFound)
+		return nil, "", ErrNotFound
+	}
+	key.PreviousPrefix, key.PreviousHash, key.PreviousExpiresAt = key.Prefix, key.Hash, &previousExpiresAt
+	key.Prefix, key.Hash, key.RotatedAt = prefix, hashAPIKey(secret), &now
+	return key, secret, nil
+}
+
+// RevokeAPIKey makes a key, and the one it replaced, invalid at once. Only
+// callers holding every scope of the key may revoke it.
+func (s adService) RevokeAPIKey(ctx context.Context, id uint) error {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "RevokeAPIKey request received", "context", fmt.Sprintf("\"id\":%d", id))
+
+	markPrivileged(ctx, fmt.Sprintf("apikey/%d", id))
+	if _, err := s.manageableAPIKey(ctx, id); err != nil {
+		level.Error(logger).Log("context", "RevokeAPIKey", "msg", err)
+		return err
+	}
+	result := s.db.Model(&APIKey{}).Where("id_api_key = ? AND revoked_at IS NULL", id).UpdateColumn("revoked_at", time.Now())
+	if result.Error != nil {
+		level.Error(logger).Log("context", "RevokeAPIKey", "msg", result.Error)
+		return result.Error
+	}
+	if result.RowsAffected < 1 {
+		level.Error(logger).Log("context", "RevokeAPIKey", "msg", ErrNotFound)
+		return ErrNotFound
+	}
+	return nil
+}
+
+// manageableAPIKey returns the key id, unless it is revoked, or has scopes
+// the caller does not hold: rotating it would hand them over.
+func (s adService) manageableAPIKey(ctx context.Context, id uint) (*APIKey, error) {
+	var key APIKey
+	result := s.db.Where("id_api_key = ? AND revoked_at IS NULL", id).First(&key)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	g, ok := grantFromContext(ctx)
+	if !ok {
+		return nil, ErrForbidden
+	}
+	for _, scope := range key.Scopes {
+		if !g.covers(scope) {
+			return nil, ErrForbidden
+		}
+	}
+	return &key, nil
+}
+
+// AuthenticateAPIKey returns the Principal of a key that is neither
+// expired nor revoked, and records its use.
+func (s adService) AuthenticateAPIKey(ctx context.Context, secret string) (*Principal, error) {
+	parts := strings.SplitN(secret, "_", 3)
+	if len(parts) != 3 || parts[0] != "am" {
+		return nil, ErrUnauthorized
+	}
+	prefix := parts[1]
+	now := time.Now()
+	var key APIKey
+	result := s.db.Where("revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", now).
+		Where("prefix = ? OR (previous_prefix = ? AND previous_expires_at > ?)", prefix, prefix, now).
+		First(&key)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrUnauthorized
+	}
+	if result.Error != nil {
+		level.Error(s.logger).Log("context", "AuthenticateAPIKey", "msg", result.Error)
+		return nil, result.Error
+	}
+	hash := key.Hash
+	if prefix != key.Prefix {
+		hash = key.PreviousHash
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(secret)), []byte(hash)) != 1 {
+		return nil, ErrUnauthorized
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyUsageInterval {
+		if result := s.db.Model(&APIKey{}).Where("id_api_key = ?", key.IdApiKey).UpdateColumn("last_used_at", now); result.Error != nil {
+			level.Error(s.logger).Log("context", "AuthenticateAPIKey", "msg", result.Error)
+		}
+	}
+	return &Principal{Subject: fmt.Sprintf("apikey/%d", key.IdApiKey), IdApiKey: key.IdApiKey, Scopes: key.Scopes}, nil
+}
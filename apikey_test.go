@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// callAs calls call as principal through a Require(action) endpoint of
+// an Authorizer with DefaultPolicy, and returns the audit records written
+// and its error.
+func callAs(principal *Principal, action string, call func(ctx context.Context) error) ([]AuditRecord, error) {
+	var records []AuditRecord
+	e := testAuthorizer(true, &records).Require(action)(func(ctx context.Context, request interface{}) (interface{}, error) {
+		return nil, call(ctx)
+	})
+	_, err := e(ContextWithPrincipal(context.Background(), principal), nil)
+	return records, err
+}
+
+func TestCreateAPIKeyScopes(t *testing.T) {
+	s := adService{logger: log.NewNopLogger(), db: dryRunDB(t)}
+	manager := &Principal{Subject: "apikey/1", IdApiKey: 1, Scopes: []string{ActionAPIKeyManage, ActionAdWrite + ":any", ActionJobRead}}
+
+	for _, tc := range []struct {
+		scope string
+		err   error
+	}{
+		{"*", ErrForbidden},
+		{ActionAPIKeyManage, nil},
+		{ActionJobRead, nil},
+		{ActionJobReplay, ErrForbidden},
+		{ActionAdWrite + ":any", nil},
+		{ActionAdWrite + ":own", nil},
+		{ActionAdDelete + ":own", ErrForbidden},
+		{ActionAdCreate, ErrForbidden},
+		{ActionAdCreate + ":any", ErrForbidden},
+		{"ad:fly", ErrInvalidScope},
+	} {
+		t.Run(tc.scope, func(t *testing.T) {
+			_, err := callAs(manager, ActionAPIKeyManage, func(ctx context.Context) error {
+				_, _, err := s.CreateAPIKey(ctx, APIKey{Name: "key", Scopes: []string{tc.scope}})
+				return err
+			})
+			if err != tc.err {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestManageAPIKeyScopes(t *testing.T) {
+	manager := &Principal{Subject: "apikey/1", IdApiKey: 1, Scopes: []string{ActionAPIKeyManage, ActionAdWrite + ":any"}}
+
+	for _, tc := range []struct {
+		name   string
+		scopes []string
+		// err is the error of calls by manager; the update of the key
+		// finds nothing when they are let through.
+		err error
+	}{
+		{"key with all scopes", []string{"*"}, ErrForbidden},
+		{"key with another scope", []string{ActionAdWrite + ":own", ActionJobReplay}, ErrForbidden},
+		{"key with held scopes", []string{ActionAPIKeyManage, ActionAdWrite + ":own"}, ErrNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := dryRunDB(t)
+			withRows(t, db, APIKey{IdApiKey: 2, Prefix: "0123456789ab", ScopeList: strings.Join(tc.scopes, ",")})
+			s := adService{logger: log.NewNopLogger(), db: db}
+
+			var secret string
+			_, err := callAs(manager, ActionAPIKeyManage, func(ctx context.Context) error {
+				var err error
+				_, secret, err = s.RotateAPIKey(ctx, 2)
+				return err
+			})
+			if err != tc.err || secret != "" {
+				t.Errorf("rotate: got %v, secret %q, want %v", err, secret, tc.err)
+			}
+			_, err = callAs(manager, ActionAPIKeyManage, func(ctx context.Context) error {
+				return s.RevokeAPIKey(ctx, 2)
+			})
+			if err != tc.err {
+				t.Errorf("revoke: got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestGrantCovers(t *testing.T) {
+	for _, tc := range []struct {
+		permissions []string
+		scope       string
+		want        bool
+	}{
+		{[]string{"*"}, "*", true},
+		{[]string{"*"}, ActionJobReplay, true},
+		{[]string{ActionAdCreate}, ActionAdCreate, true},
+		{[]string{ActionAdCreate}, ActionAdCreate + ":any", false},
+		{[]string{ActionAdCreate + ":any"}, ActionAdCreate, true},
+		{[]string{ActionAdWrite + ":any"}, ActionAdWrite + ":own", true},
+		{[]string{ActionAdWrite + ":own"}, ActionAdWrite + ":any", false},
+		{[]string{ActionAdWrite + ":any"}, "*", false},
+	} {
+		g := &grant{permissions: map[string]bool{}}
+		for _, permission := range tc.permissions {
+			g.permissions[permission] = true
+		}
+		if got := g.covers(tc.scope); got != tc.want {
+			t.Errorf("%v covers %s: got %v, want %v", tc.permissions, tc.scope, got, tc.want)
+		}
+	}
+}
+
+func TestPostAdOnBehalf(t *testing.T) {
+	s := adService{logger: log.NewNopLogger(), db: dryRunDB(t)}
+	ad := Ad{IdUser: "u1", Title: "Bike", Description: "A bike", Price: 100}
+	importer := &Principal{Subject: "apikey/1", IdApiKey: 1, Scopes: []string{ActionAdCreate}}
+	trusted := &Principal{Subject: "apikey/2", IdApiKey: 2, Scopes: []string{ActionAdCreate + ":any"}}
+
+	records, err := callAs(importer, ActionAdCreate, func(ctx context.Context) error {
+		_, err := s.PostAd(ctx, ad)
+		return err
+	})
+	if err != ErrForbidden || len(records) != 0 {
+		t.Errorf("key without ad:create:any: got %v, %+v, want ErrForbidden", err, records)
+	}
+
+	// The ad is let through, and then not stored as the transaction
+	// cannot begin.
+	records, err = callAs(trusted, ActionAdCreate, func(ctx context.Context) error {
+		_, err := s.PostAd(ctx, ad)
+		return err
+	})
+	if err == nil || err == ErrForbidden || len(records) != 1 {
+		t.Fatalf("key with ad:create:any: got %v, %+v, want a database error and an audit record", err, records)
+	}
+	records[0].Error = ""
+	want := AuditRecord{Subject: "apikey/2", Permission: "ad:create:any", Resource: "user/u1"}
+	if !reflect.DeepEqual(records[0], want) {
+		t.Errorf("got %+v, want %+v", records[0], want)
+	}
+}
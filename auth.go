@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrUnauthorized = errors.New("missing or invalid credentials")
+	ErrForbidden    = errors.New("not allowed")
+)
+
+// Principal is who a request is made by.
+type Principal struct {
+	// Subject is the sub claim of the caller's token, which ads are owned
+	// by as their IdUser.
+	Subject string
+	// Roles are the roles the caller's token grants, which Policy maps to
+	// permissions.
+	Roles []string
+	// IdApiKey is set for callers authenticated with an API key, whose
+	// Scopes are their permissions instead.
+	IdApiKey uint
+	Scopes   []string
+}
+
+type principalContextKey struct{}
+
+func ContextWithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalContextKey{}).(*Principal)
+	return principal, ok
+}
+
+// authenticate is HTTP middleware putting the Principal of requests with
+// valid credentials into their context: a bearer token, or an API key as
+// "Authorization: ApiKey {key}". Requests with invalid credentials are
+// answered 401. Requests without credentials proceed anonymously, and the
+// service decides what they may do. With a nil verifier bearer tokens are
+// ignored, as authentication is disabled.
+func authenticate(logger log.Logger, s Service, verifier *jwtVerifier) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization := r.Header.Get("Authorization")
+			var scheme, credentials string
+			if fields := strings.Fields(authorization); len(fields) == 2 {
+				scheme, credentials = fields[0], fields[1]
+			}
+
+			var principal *Principal
+			var err error
+			switch {
+			case authorization == "":
+			case strings.EqualFold(scheme, "ApiKey"):
+				principal, err = s.AuthenticateAPIKey(r.Context(), credentials)
+			case verifier == nil:
+			case strings.EqualFold(scheme, "Bearer"):
+				var claims *Claims
+				if claims, err = verifier.Verify(r.Context(), credentials); err != nil {
+					level.Error(logger).Log("context", "authenticate", "msg", err)
+					err = ErrUnauthorized
+				} else {
+					principal = &Principal{Subject: claims.Subject, Roles: claims.Roles}
+				}
+			default:
+				err = ErrUnauthorized
+			}
+			if err != nil {
+				encodeError(r.Context(), err, w)
+				return
+			}
+			if principal != nil {
+				r = r.WithContext(ContextWithPrincipal(r.Context(), principal))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authorizeAd checks that the caller owns an ad, before it or its photos are
+// changed, or was granted an ":any" permission by Authorizer. Anonymous
+// callers are let through while authentication is disabled.
+func (s adService) authorizeAd(ctx context.Context, adId uint) error {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok {
+		if s.requireAuth {
+			return ErrUnauthorized
+		}
+		return nil
+	}
+	var ad Ad
+	result := s.db.Select("id_user").First(&ad, adId)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	if ad.IdUser == principal.Subject {
+		return nil
+	}
+	if g, ok := grantFromContext(ctx); ok && g.any {
+		markPrivileged(ctx, fmt.Sprintf("ad/%d", adId))
+		return nil
+	}
+	return ErrForbidden
+}
+
+// authorizeUser checks that the caller is a user, before what the user
+// stores is read.
+func (s adService) authorizeUser(ctx context.Context, idUser string) error {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok {
+		if s.requireAuth {
+			return ErrUnauthorized
+		}
+		return nil
+	}
+	if idUser == principal.Subject {
+		return nil
+	}
+	if g, ok := grantFromContext(ctx); ok && g.any {
+		markPrivileged(ctx, "user/"+idUser)
+		return nil
+	}
+	return ErrForbidden
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"mime/multipart"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTooManyPhotos = errors.New("too many photos in one request")
+)
+
+// PhotoUpload is a photo of a batch upload.
+type PhotoUpload struct {
+	// Name is the file name the client gave, to tell results apart.
+	Name string
+	File multipart.File
+}
+
+// PhotoUploadResult is the outcome of uploading one photo of a batch:
+// either the photo or the error.
+type PhotoUploadResult struct {
+	Name  string
+	Photo *Photo
+	Err   error
+}
+
+// PostPhotos stores the photos of a batch concurrently through PostPhoto,
+// so each is validated, stripped, deduplicated and queued like a single
+// upload. One failing photo does not fail the others.
+func (s adService) PostPhotos(ctx context.Context, adId uint, uploads []PhotoUpload, onDuplicate string) ([]PhotoUploadResult, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "PostPhotos request received", "context", fmt.Sprintf("\"id\":%d,\"count\":%d", adId, len(uploads)))
+
+	if len(uploads) == 0 {
+		level.Error(logger).Log("context", "PostPhotos", "msg", ErrMissingFields)
+		return nil, ErrMissingFields
+	}
+	err := s.authorizeAd(ctx, adId)
+	if err == nil && s.limits.MaxBatch > 0 && len(uploads) > s.limits.MaxBatch {
+		err = ErrTooManyPhotos
+	}
+	if err != nil {
+		for _, upload := range uploads {
+			upload.File.Close()
+		}
+		level.Error(logger).Log("context", "PostPhotos", "msg", err)
+		return nil, err
+	}
+
+	// Each photo goes through PostPhoto, at most uploadWorkers at a time.
+	results := make([]PhotoUploadResult, len(uploads))
+	workers := make(chan struct{}, s.uploadWorkers)
+	var wg sync.WaitGroup
+	for i, upload := range uploads {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, upload PhotoUpload) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			// A photo crashing its worker fails alone, like any other error.
+			defer func() {
+				if r := recover(); r != nil {
+					level.Error(logger).Log("context", "PostPhotos", "msg", fmt.Sprintf("panic: %v", r), "name", upload.Name, "stack", string(debug.Stack()))
+					results[i] = PhotoUploadResult{Name: upload.Name, Err: ErrUpload}
+				}
+			}()
+			photo, err := s.PostPhoto(ctx, adId, upload.File, onDuplicate)
+			results[i] = PhotoUploadResult{Name: upload.Name, Photo: photo, Err: err}
+		}(i, upload)
+	}
+	wg.Wait()
+	return results, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/go-kit/kit/log"
+	"testing"
+)
+
+// testFile is a multipart.File over data that panics when read if
+// panics is set.
+type testFile struct {
+	*bytes.Reader
+	panics bool
+	closed bool
+}
+
+func (f *testFile) Read(p []byte) (int, error) {
+	if f.panics {
+		panic("corrupt file")
+	}
+	return f.Reader.Read(p)
+}
+
+func (f *testFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestPostPhotosRecoversPanics(t *testing.T) {
+	s := adService{logger: log.NewNopLogger(), uploadWorkers: 2}
+	crashing := &testFile{Reader: bytes.NewReader(testPNG), panics: true}
+	invalid := &testFile{Reader: bytes.NewReader([]byte("not an image"))}
+	results, err := s.PostPhotos(context.Background(), 1, []PhotoUpload{
+		{Name: "crashing.png", File: crashing},
+		{Name: "invalid.txt", File: invalid},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if results[0].Name != "crashing.png" || results[0].Err != ErrUpload || results[0].Photo != nil {
+		t.Errorf("crashing file: got %+v, want ErrUpload", results[0])
+	}
+	if results[1].Name != "invalid.txt" || results[1].Err != ErrUnsupportedMediaType {
+		t.Errorf("invalid file: got %+v, want ErrUnsupportedMediaType", results[1])
+	}
+	if !crashing.closed || !invalid.closed {
+		t.Errorf("files left open")
+	}
+}
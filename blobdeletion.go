@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+// BlobDeletion is a pending removal of stored objects. Rows are written in the
+// same transaction that deletes the photos owning the objects, so a blob is
+// never forgotten even if removing it fails or the process dies first.
+type BlobDeletion struct {
+	IdBlobDeletion uint   `json:"id" gorm:"primaryKey"`
+	ObjectName     string `json:"object_name"`
+	// Prefix removes every object whose name starts with ObjectName, which
+	// covers the variants the image processor derives from an original.
+	Prefix        bool      `json:"prefix"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error"`
+	NextAttemptAt time.Time `json:"next_attempt_at" gorm:"index"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func (BlobDeletion) TableName() string {
+	return "t_blob_deletion"
+}
+
+// photoBlobDeletions returns the deletions that remove the stored objects of
+// photos. Variants are covered by the prefix of the original unless their
+// Variants are loaded and named otherwise.
+func photoBlobDeletions(photos []Photo) []BlobDeletion {
+	deletions := []BlobDeletion{}
+	for _, photo := range photos {
+		if photo.ObjectName == "" {
+			continue
+		}
+		deletions = append(deletions, BlobDeletion{ObjectName: photo.ObjectName, Prefix: true, NextAttemptAt: time.Now()})
+		for _, variant := range photo.Variants {
+			if variant.ObjectName != "" && !strings.HasPrefix(variant.ObjectName, photo.ObjectName) {
+				deletions = append(deletions, BlobDeletion{ObjectName: variant.ObjectName, NextAttemptAt: time.Now()})
+			}
+		}
+	}
+	return deletions
+}
+
+// BlobPurger carries out BlobDeletions and reschedules the ones that fail.
+type BlobPurger struct {
+	logger    log.Logger
+	db        *gorm.DB
+	blobStore BlobStore
+}
+
+func NewBlobPurger(logger log.Logger, db *gorm.DB, blobStore BlobStore) *BlobPurger {
+	return &BlobPurger{
+		logger:    log.With(logger, "component", "BlobPurger"),
+		db:        db,
+		blobStore: blobStore,
+	}
+}
+
+// Purge attempts deletions once. Done deletions are removed from the table,
+// failed ones get their attempt recorded and are left for Run to retry.
+func (p *BlobPurger) Purge(ctx context.Context, deletions []BlobDeletion) {
+	for _, deletion := range deletions {
+		err := p.remove(ctx, deletion)
+		if err == nil {
+			if result := p.db.Delete(&deletion); result.Error != nil {
+				level.Error(p.logger).Log("context", "Purge", "msg", result.Error)
+			}
+			continue
+		}
+
+		level.Error(p.logger).Log("context", "Purge", "object", deletion.ObjectName, "msg", err)
+		deletion.Attempts++
+		deletion.LastError = err.Error()
+		deletion.NextAttemptAt = time.Now().Add(blobDeletionBackoff(deletion.Attempts))
+		if result := p.db.Save(&deletion); result.Error != nil {
+			level.Error(p.logger).Log("context", "Purge", "msg", result.Error)
+		}
+	}
+}
+
+// remove deletes the objects of a deletion. Objects that are already gone
+// count as removed. Objects still referenced, as content-addressed objects
+// shared by the photos of several ads are, are left alone.
+func (p *BlobPurger) remove(ctx context.Context, deletion BlobDeletion) error {
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockObject(tx, deletion.ObjectName); err != nil {
+			return err
+		}
+		var photos, variants int64
+		if result := tx.Model(&Photo{}).Where("object_name = ?", deletion.ObjectName).Count(&photos); result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Model(&PhotoVariant{}).Where("object_name = ?", deletion.ObjectName).Count(&variants); result.Error != nil {
+			return result.Error
+		}
+		if photos+variants > 0 {
+			return nil
+		}
+		return p.removeObjects(ctx, deletion)
+	})
+}
+
+func (p *BlobPurger) removeObjects(ctx context.Context, deletion BlobDeletion) error {
+	names := []string{deletion.ObjectName}
+	if deletion.Prefix {
+		blobs, err := p.blobStore.List(ctx, deletion.ObjectName)
+		if err != nil {
+			return err
+		}
+		names = names[:0]
+		for _, blob := range blobs {
+			names = append(names, blob.Name)
+		}
+	}
+	for _, name := range names {
+		if err := p.blobStore.Delete(ctx, name); err != nil && err != ErrBlobNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run retries due deletions every interval until ctx is done.
+func (p *BlobPurger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deletions := []BlobDeletion{}
+		result := p.db.Where("next_attempt_at <= ?", time.Now()).Order("next_attempt_at").Limit(100).Find(&deletions)
+		if result.Error != nil {
+			level.Error(p.logger).Log("context", "Run", "msg", result.Error)
+			continue
+		}
+		if len(deletions) > 0 {
+			level.Info(p.logger).Log("context", "Run", "msg", "Retrying blob deletions", "count", len(deletions))
+			p.Purge(ctx, deletions)
+		}
+	}
+}
+
+// blobDeletionBackoff doubles the wait after each failed attempt, from one
+// minute up to a day.
+func blobDeletionBackoff(attempts int) time.Duration {
+	backoff := time.Minute
+	for i := 1; i < attempts && backoff < 24*time.Hour; i++ {
+		backoff *= 2
+	}
+	if backoff > 24*time.Hour {
+		backoff = 24 * time.Hour
+	}
+	return backoff
+}
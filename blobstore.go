@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	ErrBlobNotFound   = errors.New("blob not found")
+	ErrUnknownBackend = errors.New("unknown storage backend")
+)
+
+// BlobStore is where photo objects live. Object names are flat strings such
+// as "{adId}-{nanos}"; a "/" in a name is allowed and treated as a path
+// separator by backends that have one.
+type BlobStore interface {
+	// Put stores the content read from reader under name, replacing any
+	// existing object. An empty contentType lets the backend detect it.
+	Put(ctx context.Context, name string, reader io.Reader, contentType string) error
+	// Get returns a reader of the object's content or ErrBlobNotFound. The
+	// caller closes it.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// Delete removes the object. It returns ErrBlobNotFound if there is none.
+	Delete(ctx context.Context, name string) error
+	// Stat returns the object's attributes or ErrBlobNotFound.
+	Stat(ctx context.Context, name string) (*BlobInfo, error)
+	// List returns the objects whose names start with prefix, ordered by
+	// name.
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+	// URL returns the public URL the object is served from.
+	URL(name string) string
+}
+
+// UploadSigner is implemented by stores that let clients upload objects
+// directly, without going through ad-manager.
+type UploadSigner interface {
+	// SignUpload returns a URL that accepts a PUT of the object, with the
+	// given Content-Type, until expires.
+	SignUpload(name string, contentType string, expires time.Time) (string, error)
+}
+
+type BlobInfo struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	Updated     time.Time `json:"updated"`
+}
+
+// BlobStoreConfig selects and configures a BlobStore backend.
+type BlobStoreConfig struct {
+	// Backend is one of "gcs", "s3", "local" or "memory".
+	Backend string
+	// Bucket is the GCS or S3 bucket name.
+	Bucket string
+	// GCPCredentialsJSON holds the service account key used by "gcs".
+	GCPCredentialsJSON string
+	// S3 configures "s3". Its Bucket and PublicURL are taken from the
+	// fields above.
+	S3 S3Config
+	// LocalDir is the directory "local" stores objects in.
+	LocalDir string
+	// PublicURL is the base URL "s3", "local" and "memory" objects are
+	// served from. The object name is appended to it.
+	PublicURL string
+}
+
+func NewBlobStore(ctx context.Context, config BlobStoreConfig) (BlobStore, error) {
+	var (
+		store BlobStore
+		err   error
+	)
+	switch config.Backend {
+	case "gcs":
+		store, err = NewGCSBlobStore(ctx, config.Bucket, config.GCPCredentialsJSON)
+	case "s3":
+		s3Config := config.S3
+		s3Config.Bucket = config.Bucket
+		s3Config.PublicURL = config.PublicURL
+		store, err = NewS3BlobStore(s3Config)
+	case "local":
+		store, err = NewLocalBlobStore(config.LocalDir, config.PublicURL)
+	case "memory":
+		store = NewMemoryBlobStore(config.PublicURL)
+	default:
+		err = fmt.Errorf("%w: %q", ErrUnknownBackend, config.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
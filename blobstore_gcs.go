@@ -0,0 +1,131 @@
+package main
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"io"
+	"net/http"
+	"time"
+)
+
+// gcsBlobStore keeps objects in a Google Cloud Storage bucket.
+type gcsBlobStore struct {
+	client *storage.Client
+	bucket string
+	// The service account signing upload URLs, from the credentials.
+	clientEmail string
+	privateKey  []byte
+}
+
+func NewGCSBlobStore(ctx context.Context, bucket string, credentialsJSON string) (*gcsBlobStore, error) {
+	client, err := storage.NewClient(ctx, option.WithCredentialsJSON([]byte(credentialsJSON)))
+	if err != nil {
+		return nil, err
+	}
+	var credentials struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+	}
+	// Credentials other than service account keys cannot sign URLs, which
+	// SignUpload reports.
+	json.Unmarshal([]byte(credentialsJSON), &credentials)
+	return &gcsBlobStore{
+		client:      client,
+		bucket:      bucket,
+		clientEmail: credentials.ClientEmail,
+		privateKey:  []byte(credentials.PrivateKey),
+	}, nil
+}
+
+func (s *gcsBlobStore) Put(ctx context.Context, name string, reader io.Reader, contentType string) error {
+	writer := s.client.Bucket(s.bucket).Object(name).NewWriter(ctx)
+	writer.ContentType = contentType
+	if _, err := io.Copy(writer, reader); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+func (s *gcsBlobStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	reader, err := s.client.Bucket(s.bucket).Object(name).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+func (s *gcsBlobStore) Delete(ctx context.Context, name string) error {
+	err := s.client.Bucket(s.bucket).Object(name).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+func (s *gcsBlobStore) Stat(ctx context.Context, name string) (*BlobInfo, error) {
+	attrs, err := s.client.Bucket(s.bucket).Object(name).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &BlobInfo{
+		Name:        attrs.Name,
+		Size:        attrs.Size,
+		ContentType: attrs.ContentType,
+		Updated:     attrs.Updated,
+	}, nil
+}
+
+func (s *gcsBlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	blobs := []BlobInfo{}
+	objects := s.client.Bucket(s.bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			return blobs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, BlobInfo{
+			Name:        attrs.Name,
+			Size:        attrs.Size,
+			ContentType: attrs.ContentType,
+			Updated:     attrs.Updated,
+		})
+	}
+}
+
+func (s *gcsBlobStore) URL(name string) string {
+	return fmt.Sprintf("https://storage.googleapis.com/%s/%s", s.bucket, name)
+}
+
+// SignUpload returns a V4 signed URL.
+func (s *gcsBlobStore) SignUpload(name string, contentType string, expires time.Time) (string, error) {
+	if s.clientEmail == "" || len(s.privateKey) == 0 {
+		return "", errors.New("gcs credentials are not a service account key and cannot sign urls")
+	}
+	return storage.SignedURL(s.bucket, name, &storage.SignedURLOptions{
+		GoogleAccessID: s.clientEmail,
+		PrivateKey:     s.privateKey,
+		Method:         http.MethodPut,
+		Expires:        expires,
+		ContentType:    contentType,
+		Scheme:         storage.SigningSchemeV4,
+	})
+}
+
+func (s *gcsBlobStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInvalidBlobName = errors.New("invalid blob name")
+)
+
+// localBlobStore keeps objects as files below a directory. It is meant for
+// development; serving the directory at publicURL is left to the operator.
+type localBlobStore struct {
+	dir       string
+	publicURL string
+}
+
+func NewLocalBlobStore(dir string, publicURL string) (*localBlobStore, error) {
+	if dir == "" {
+		return nil, errors.New("local storage directory not configured")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localBlobStore{dir: dir, publicURL: strings.TrimSuffix(publicURL, "/")}, nil
+}
+
+// path maps an object name to a file below dir, refusing names that would
+// escape it.
+func (s *localBlobStore) path(name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if name == "" || clean == "/" || clean[1:] != name {
+		return "", ErrInvalidBlobName
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), nil
+}
+
+func (s *localBlobStore) Put(ctx context.Context, name string, reader io.Reader, contentType string) error {
+	target, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers never see a partial object.
+	file, err := ioutil.TempFile(filepath.Dir(target), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), target)
+}
+
+func (s *localBlobStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	target, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(target)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, name string) error {
+	target, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(target)
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+func (s *localBlobStore) Stat(ctx context.Context, name string) (*BlobInfo, error) {
+	target, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(target)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		return nil, ErrBlobNotFound
+	}
+	// The filesystem keeps no content type, so sniff it like GCS does for
+	// uploads without one.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return &BlobInfo{
+		Name:        name,
+		Size:        stat.Size(),
+		ContentType: http.DetectContentType(head[:n]),
+		Updated:     stat.ModTime(),
+	}, nil
+}
+
+func (s *localBlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	blobs := []BlobInfo{}
+	err := filepath.Walk(s.dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, file)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		blobs = append(blobs, BlobInfo{
+			Name:    name,
+			Size:    info.Size(),
+			Updated: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Walk visits files in lexical order of their path, which differs from
+	// name order once names contain slashes.
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Name < blobs[j].Name })
+	return blobs, nil
+}
+
+func (s *localBlobStore) URL(name string) string {
+	return s.publicURL + "/" + name
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryBlobStore keeps objects in memory. It needs no credentials, which
+// makes it handy for tests and for running the service locally.
+type memoryBlobStore struct {
+	mutex     sync.RWMutex
+	blobs     map[string]memoryBlob
+	publicURL string
+}
+
+type memoryBlob struct {
+	data        []byte
+	contentType string
+	updated     time.Time
+}
+
+func NewMemoryBlobStore(publicURL string) *memoryBlobStore {
+	return &memoryBlobStore{
+		blobs:     map[string]memoryBlob{},
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+	}
+}
+
+func (s *memoryBlobStore) Put(ctx context.Context, name string, reader io.Reader, contentType string) error {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.blobs[name] = memoryBlob{data: data, contentType: contentType, updated: time.Now()}
+	return nil
+}
+
+func (s *memoryBlobStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	blob, ok := s.blobs[name]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(blob.data)), nil
+}
+
+func (s *memoryBlobStore) Delete(ctx context.Context, name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.blobs[name]; !ok {
+		return ErrBlobNotFound
+	}
+	delete(s.blobs, name)
+	return nil
+}
+
+func (s *memoryBlobStore) Stat(ctx context.Context, name string) (*BlobInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	blob, ok := s.blobs[name]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	return &BlobInfo{
+		Name:        name,
+		Size:        int64(len(blob.data)),
+		ContentType: blob.contentType,
+		Updated:     blob.updated,
+	}, nil
+}
+
+func (s *memoryBlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	blobs := []BlobInfo{}
+	for name, blob := range s.blobs {
+		if strings.HasPrefix(name, prefix) {
+			blobs = append(blobs, BlobInfo{
+				Name:        name,
+				Size:        int64(len(blob.data)),
+				ContentType: blob.contentType,
+				Updated:     blob.updated,
+			})
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Name < blobs[j].Name })
+	return blobs, nil
+}
+
+func (s *memoryBlobStore) URL(name string) string {
+	return s.publicURL + "/" + name
+}
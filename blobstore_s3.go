@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3UnsignedPayload lets uploads stream without hashing the body up front.
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3Config configures an S3-compatible store such as AWS S3 or MinIO.
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. "https://s3.eu-central-1.amazonaws.com"
+	// or "http://minio:9000".
+	Endpoint string
+	Region   string
+	Bucket   string
+	// PathStyle addresses objects as {endpoint}/{bucket}/{name} instead of
+	// {bucket}.{endpoint host}/{name}. MinIO needs it.
+	PathStyle       bool
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// PublicURL overrides the base URL objects are served from, e.g. a CDN.
+	PublicURL string
+}
+
+// s3BlobStore talks to the S3 REST API directly, signing requests with AWS
+// Signature Version 4.
+type s3BlobStore struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3BlobStore(config S3Config) (*s3BlobStore, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.New("s3 endpoint and bucket must be configured")
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("s3 credentials not configured")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", config.Endpoint)
+	}
+	config.PublicURL = strings.TrimSuffix(config.PublicURL, "/")
+	return &s3BlobStore{config: config, endpoint: endpoint, client: &http.Client{}}, nil
+}
+
+// objectURL returns the request URL of an object, honoring the addressing
+// style.
+func (s *s3BlobStore) objectURL(name string) *url.URL {
+	u := *s.endpoint
+	if s.config.PathStyle {
+		u.Path = u.Path + "/" + s.config.Bucket + "/" + name
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+		u.Path = u.Path + "/" + name
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	return &u
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, name string, reader io.Reader, contentType string) error {
+	// S3 wants a Content-Length, so measure seekable readers and buffer
+	// anything else.
+	var body io.Reader
+	var size int64
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		body, size = seeker, end-start
+	} else {
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		body, size = bytes.NewReader(data), int64(len(data))
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(name).String(), body)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = size
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	response, err := s.do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(name).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.do(request)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, name string) error {
+	// S3 answers 204 whether or not the object existed, so look first.
+	if _, err := s.Stat(ctx, name); err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(name).String(), nil)
+	if err != nil {
+		return err
+	}
+	response, err := s.do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (s *s3BlobStore) Stat(ctx context.Context, name string) (*BlobInfo, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, s.objectURL(name).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.do(request)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	size, _ := strconv.ParseInt(response.Header.Get("Content-Length"), 10, 64)
+	updated, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+	return &BlobInfo{
+		Name:        name,
+		Size:        size,
+		ContentType: response.Header.Get("Content-Type"),
+		Updated:     updated,
+	}, nil
+}
+
+func (s *s3BlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	listURL := *s.endpoint
+	if s.config.PathStyle {
+		listURL.Path = listURL.Path + "/" + s.config.Bucket
+	} else {
+		listURL.Host = s.config.Bucket + "." + listURL.Host
+		listURL.Path = listURL.Path + "/"
+	}
+	listURL.RawPath = s3EscapePath(listURL.Path)
+
+	blobs := []BlobInfo{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		listURL.RawQuery = s3CanonicalQuery(query)
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, listURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		response, err := s.do(request)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			blobs = append(blobs, BlobInfo{Name: object.Key, Size: object.Size, Updated: object.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return blobs, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *s3BlobStore) URL(name string) string {
+	if s.config.PublicURL != "" {
+		return s.config.PublicURL + "/" + s3EscapePath(name)
+	}
+	return s.objectURL(name).String()
+}
+
+// SignUpload returns a presigned URL, signed with AWS Signature Version 4
+// in the query string. S3 allows at most a week until expires.
+func (s *s3BlobStore) SignUpload(name string, contentType string, expires time.Time) (string, error) {
+	now := time.Now().UTC()
+	seconds := int64(expires.Sub(now) / time.Second)
+	if seconds < 1 || seconds > 7*24*60*60 {
+		return "", fmt.Errorf("s3 presigned url expiry out of range: %ds", seconds)
+	}
+	return s.presign(http.MethodPut, name, map[string]string{"content-type": contentType}, now, seconds), nil
+}
+
+// presign returns the URL of a request for an object that is valid for
+// seconds from now. The request has to carry headers, which are signed
+// along with the host.
+func (s *s3BlobStore) presign(method string, name string, headers map[string]string, now time.Time, seconds int64) string {
+	amzDate := now.Format("20060102T150405Z")
+	u := s.objectURL(name)
+	signed := map[string]string{"host": u.Host}
+	for key, value := range headers {
+		signed[strings.ToLower(key)] = value
+	}
+	canonicalHeaders, signedHeaders := s3CanonicalHeaders(signed)
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.config.AccessKeyID + "/" + s.scope(now)},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.FormatInt(seconds, 10)},
+		"X-Amz-SignedHeaders": {signedHeaders},
+	}
+	if s.config.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", s.config.SessionToken)
+	}
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		s3CanonicalQuery(query),
+		canonicalHeaders,
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+	query.Set("X-Amz-Signature", s.signature(now, amzDate, canonicalRequest))
+	u.RawQuery = s3CanonicalQuery(query)
+	return u.String()
+}
+
+// do signs and sends a request. Non-2xx responses are turned into errors,
+// 404 into ErrBlobNotFound.
+func (s *s3BlobStore) do(request *http.Request) (*http.Response, error) {
+	s.sign(request, time.Now().UTC())
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return response, nil
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, ErrBlobNotFound
+	}
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	raw, _ := ioutil.ReadAll(io.LimitReader(response.Body, 64<<10))
+	if xml.Unmarshal(raw, &s3Err) != nil || s3Err.Code == "" {
+		s3Err.Code = response.Status
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s %s", request.Method, request.URL.Path, s3Err.Code, s3Err.Message)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to request.
+// The payload is left unsigned unless X-Amz-Content-Sha256 is set already.
+func (s *s3BlobStore) sign(request *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	request.Header.Set("X-Amz-Date", amzDate)
+	payloadHash := request.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = s3UnsignedPayload
+		request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	if s.config.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", s.config.SessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for key, values := range request.Header {
+		key = strings.ToLower(key)
+		if key == "content-type" || strings.HasPrefix(key, "x-amz-") {
+			headers[key] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	canonicalHeaders, signedHeaders := s3CanonicalHeaders(headers)
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		s3CanonicalQuery(request.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := s.scope(now)
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyID, scope, signedHeaders, s.signature(now, amzDate, canonicalRequest)))
+}
+
+func (s *s3BlobStore) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.config.Region + "/s3/aws4_request"
+}
+
+func (s *s3BlobStore) signature(now time.Time, amzDate string, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + s.scope(now) + "\n" + hex.EncodeToString(hash[:])
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalHeaders returns the canonical headers and signed headers of
+// SigV4 for headers, whose keys are lower case.
+func s3CanonicalHeaders(headers map[string]string) (string, string) {
+	names := make([]string, 0, len(headers))
+	for key := range headers {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, key := range names {
+		canonicalHeaders.WriteString(key + ":" + headers[key] + "\n")
+	}
+	return canonicalHeaders.String(), strings.Join(names, ";")
+}
+
+// s3CanonicalQuery encodes query parameters sorted by key, as SigV4 requires.
+func s3CanonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		vals := append([]string(nil), values[key]...)
+		sort.Strings(vals)
+		for _, value := range vals {
+			parts = append(parts, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3EscapePath percent-encodes an object path, leaving the slashes alone.
+func s3EscapePath(path string) string {
+	return s3Escape(path, false)
+}
+
+// s3Escape percent-encodes everything except the unreserved characters of
+// RFC 3986, and "/" unless encodeSlash is set.
+func s3Escape(value string, encodeSlash bool) string {
+	var builder strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			builder.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			builder.WriteByte(b)
+		default:
+			fmt.Fprintf(&builder, "%%%02X", b)
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testPNG starts like a PNG, so that backends sniffing the content type
+// agree with the one it is stored with.
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR test content")
+
+// testBlobStore runs the contract every BlobStore backend has to meet.
+func testBlobStore(t *testing.T, store BlobStore, publicURL string) {
+	ctx := context.Background()
+
+	t.Run("missing", func(t *testing.T) {
+		if _, err := store.Get(ctx, "missing"); !errors.Is(err, ErrBlobNotFound) {
+			t.Errorf("Get: got %v, want ErrBlobNotFound", err)
+		}
+		if _, err := store.Stat(ctx, "missing"); !errors.Is(err, ErrBlobNotFound) {
+			t.Errorf("Stat: got %v, want ErrBlobNotFound", err)
+		}
+		if err := store.Delete(ctx, "missing"); !errors.Is(err, ErrBlobNotFound) {
+			t.Errorf("Delete: got %v, want ErrBlobNotFound", err)
+		}
+	})
+
+	t.Run("put get stat delete", func(t *testing.T) {
+		if err := store.Put(ctx, "ad/1-1", bytes.NewReader(testPNG), "image/png"); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		assertBlobContent(t, store, "ad/1-1", testPNG)
+		info, err := store.Stat(ctx, "ad/1-1")
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if info.Name != "ad/1-1" || info.Size != int64(len(testPNG)) || info.ContentType != "image/png" {
+			t.Errorf("Stat: got %+v", info)
+		}
+		if info.Updated.IsZero() {
+			t.Errorf("Stat: Updated not set")
+		}
+
+		// Readers that cannot seek are stored as well, and replace the
+		// object.
+		replaced := append([]byte{}, testPNG...)
+		replaced = append(replaced, " replaced"...)
+		if err := store.Put(ctx, "ad/1-1", ioutil.NopCloser(bytes.NewReader(replaced)), "image/png"); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		assertBlobContent(t, store, "ad/1-1", replaced)
+
+		if err := store.Delete(ctx, "ad/1-1"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := store.Stat(ctx, "ad/1-1"); !errors.Is(err, ErrBlobNotFound) {
+			t.Errorf("Stat after Delete: got %v, want ErrBlobNotFound", err)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		names := []string{"list/b", "list/a/2", "list-c", "list/a/1", "other"}
+		for i, name := range names {
+			if err := store.Put(ctx, name, bytes.NewReader(testPNG[:i+1]), ""); err != nil {
+				t.Fatalf("Put %s: %v", name, err)
+			}
+		}
+		blobs, err := store.List(ctx, "list")
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		var got []string
+		for _, blob := range blobs {
+			got = append(got, blob.Name+":"+strconv.FormatInt(blob.Size, 10))
+		}
+		want := []string{"list-c:3", "list/a/1:4", "list/a/2:2", "list/b:1"}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("List: got %v, want %v", got, want)
+		}
+
+		blobs, err = store.List(ctx, "nothing")
+		if err != nil || len(blobs) != 0 {
+			t.Errorf("List of unknown prefix: got %v, %v", blobs, err)
+		}
+	})
+
+	t.Run("url", func(t *testing.T) {
+		if got := store.URL("ad/1-1"); got != publicURL+"/ad/1-1" {
+			t.Errorf("URL: got %q, want %q", got, publicURL+"/ad/1-1")
+		}
+	})
+}
+
+func assertBlobContent(t *testing.T, store BlobStore, name string, want []byte) {
+	t.Helper()
+	reader, err := store.Get(context.Background(), name)
+	if err != nil {
+		t.Fatalf("Get %s: %v", name, err)
+	}
+	defer reader.Close()
+	got, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Get %s: %v", name, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Get %s: got %q, want %q", name, got, want)
+	}
+}
+
+func TestMemoryBlobStore(t *testing.T) {
+	testBlobStore(t, NewMemoryBlobStore("http://cdn.test/photos/"), "http://cdn.test/photos")
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewLocalBlobStore(dir, "http://cdn.test/photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store, "http://cdn.test/photos")
+}
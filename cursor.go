@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// pageCursor marks the last row of a page for keyset pagination. Clients only
+// ever see it as an opaque token, which they send back to get the next page.
+// Because it holds the sort key of the last row instead of an offset, pages
+// stay stable while new rows are inserted.
+type pageCursor struct {
+	Sort  string     `json:"s"`
+	Price float32    `json:"p,omitempty"`
+	Time  *time.Time `json:"t,omitempty"`
+	Rank  float32    `json:"r,omitempty"`
+	ID    uint       `json:"i"`
+}
+
+func (c pageCursor) encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodePageCursor parses a token produced by encode and checks that it was
+// issued for the same sort order.
+func decodePageCursor(token string, sort string) (*pageCursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c pageCursor
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if c.Sort != sort || c.ID == 0 {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// pageSize clamps a client supplied limit to sane bounds.
+func pageSize(limit int) int {
+	if limit <= 0 {
+		return defaultPageSize
+	}
+	if limit > maxPageSize {
+		return maxPageSize
+	}
+	return limit
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/jackc/pgconn"
+	"gorm.io/gorm"
+	"regexp"
+)
+
+var (
+	ErrDuplicatePhoto = errors.New("the ad already has this photo")
+)
+
+// What PostPhoto does when the ad already has the uploaded photo.
+const (
+	// DuplicateReturn answers with the photo the ad already has.
+	DuplicateReturn = "return"
+	// DuplicateReject fails with ErrDuplicatePhoto.
+	DuplicateReject = "reject"
+)
+
+// contentObjectName matches the names of content-addressed originals,
+// "sha256/{hash}", and captures that part of the names of their variants.
+var contentObjectName = regexp.MustCompile(`^sha256/[0-9a-f]{64}`)
+
+// contentHash returns the hex encoded SHA-256 of a photo as stored.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// migrateDedup makes content hashes unique per ad. Photos stored before
+// hashing have none.
+func migrateDedup(db *gorm.DB) error {
+	return db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_photo_ad_content_hash ON t_photo (id_ad, content_hash) " +
+		"WHERE content_hash IS NOT NULL AND content_hash <> ''").Error
+}
+
+// lockObject serializes the transactions storing and deleting a blob, so a
+// content-addressed blob is not deleted while a photo sharing it is added.
+// The lock is held until the transaction ends.
+func lockObject(tx *gorm.DB, name string) error {
+	return tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", name).Error
+}
+
+// duplicatePhoto returns the photo of an ad with the given content hash, or
+// nil if there is none. With DuplicateReject, finding one is an error.
+func (s adService) duplicatePhoto(adId uint, hash string, onDuplicate string) (*Photo, error) {
+	var photo Photo
+	result := s.db.Preload("Variants").Where("id_ad = ? AND content_hash = ?", adId, hash).First(&photo)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if onDuplicate == DuplicateReject {
+		return nil, ErrDuplicatePhoto
+	}
+	photo.Duplicate = true
+	return &photo, nil
+}
+
+// isUniqueViolation tells whether err is a Postgres unique_violation.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/jackc/pgconn"
+	"gorm.io/gorm"
+	"testing"
+)
+
+// withQueryError makes queries of db fail with err.
+func withQueryError(t *testing.T, db *gorm.DB, err error) {
+	if err := db.Callback().Query().Before("gorm:preload").Register("test:error", func(tx *gorm.DB) {
+		tx.AddError(err)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDuplicatePhoto(t *testing.T) {
+	failure := errors.New("connection lost")
+	hash := contentHash(testPNG)
+	existing := Photo{IdPhoto: 7, IdAd: 1, ObjectName: "sha256/" + hash, ContentHash: hash}
+
+	for _, tc := range []struct {
+		name        string
+		found       bool
+		queryErr    error
+		onDuplicate string
+		photo       uint
+		err         error
+	}{
+		{"duplicate returned", true, nil, DuplicateReturn, 7, nil},
+		{"duplicate returned by default", true, nil, "", 7, nil},
+		{"duplicate rejected", true, nil, DuplicateReject, 0, ErrDuplicatePhoto},
+		{"no duplicate", false, gorm.ErrRecordNotFound, DuplicateReturn, 0, nil},
+		{"no duplicate to reject", false, gorm.ErrRecordNotFound, DuplicateReject, 0, nil},
+		{"failed query", false, failure, DuplicateReject, 0, failure},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := dryRunDB(t)
+			if tc.found {
+				withRows(t, db, existing)
+			}
+			if tc.queryErr != nil {
+				withQueryError(t, db, tc.queryErr)
+			}
+			s := adService{logger: log.NewNopLogger(), db: db}
+			photo, err := s.duplicatePhoto(1, hash, tc.onDuplicate)
+			if err != tc.err {
+				t.Fatalf("got %v, want %v", err, tc.err)
+			}
+			switch {
+			case tc.photo == 0 && photo != nil:
+				t.Errorf("got photo %+v, want none", photo)
+			case tc.photo != 0 && (photo == nil || photo.IdPhoto != tc.photo || !photo.Duplicate):
+				t.Errorf("got photo %+v, want photo %d marked duplicate", photo, tc.photo)
+			}
+		})
+	}
+}
+
+func TestIsUniqueViolation(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&pgconn.PgError{Code: "23505"}, true},
+		{fmt.Errorf("creating photo: %w", &pgconn.PgError{Code: "23505"}), true},
+		{&pgconn.PgError{Code: "23503"}, false},
+		{errors.New("duplicate key value violates unique constraint"), false},
+		{gorm.ErrRecordNotFound, false},
+		{nil, false},
+	} {
+		if got := isUniqueViolation(tc.err); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
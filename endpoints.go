@@ -3,7 +3,10 @@ package main
 import (
 	"context"
 	"github.com/go-kit/kit/endpoint"
+	"io"
 	"mime/multipart"
+	"net/http"
+	"strconv"
 )
 
 // Endpoints collects all of the endpoints that compose a profile service. It's
@@ -17,21 +20,138 @@ import (
 // Endpoints struct in a server.)
 type Endpoints struct {
 	// Ad endpoints
-	PostAdEndpoint   endpoint.Endpoint
-	PutAdEndpoint    endpoint.Endpoint
-	DeleteAdEndpoint endpoint.Endpoint
+	GetAdEndpoint     endpoint.Endpoint
+	ListAdsEndpoint   endpoint.Endpoint
+	SearchAdsEndpoint endpoint.Endpoint
+	PostAdEndpoint    endpoint.Endpoint
+	PutAdEndpoint     endpoint.Endpoint
+	DeleteAdEndpoint  endpoint.Endpoint
 	// Photo endpoints
+	GetPhotoEndpoint    endpoint.Endpoint
 	PostPhotoEndpoint   endpoint.Endpoint
+	PostPhotosEndpoint  endpoint.Endpoint
 	DeletePhotoEndpoint endpoint.Endpoint
+	WatchPhotoEndpoint  endpoint.Endpoint
+	// Photo order endpoints
+	ReorderPhotosEndpoint endpoint.Endpoint
+	SetCoverPhotoEndpoint endpoint.Endpoint
+	// Direct upload endpoints
+	CreateUploadURLEndpoint endpoint.Endpoint
+	ConfirmUploadEndpoint   endpoint.Endpoint
+	PutSignedUploadEndpoint endpoint.Endpoint
+	// Resumable upload endpoints
+	CreateUploadEndpoint   endpoint.Endpoint
+	GetUploadEndpoint      endpoint.Endpoint
+	PatchUploadEndpoint    endpoint.Endpoint
+	FinalizeUploadEndpoint endpoint.Endpoint
+	DeleteUploadEndpoint   endpoint.Endpoint
+	// Processing job endpoints
+	ListProcessingJobsEndpoint  endpoint.Endpoint
+	ReplayProcessingJobEndpoint endpoint.Endpoint
+	// User endpoints
+	GetUsageEndpoint endpoint.Endpoint
+	// API key endpoints
+	CreateAPIKeyEndpoint endpoint.Endpoint
+	ListAPIKeysEndpoint  endpoint.Endpoint
+	RotateAPIKeyEndpoint endpoint.Endpoint
+	RevokeAPIKeyEndpoint endpoint.Endpoint
 }
 
-func MakeEndpoints(service Service) Endpoints {
-	return Endpoints{
+// MakeEndpoints makes the endpoints of a service. Those changing ads and
+// photos, reading usage or managing processing jobs require the permissions
+// of authorizer.
+func MakeEndpoints(service Service, authorizer *Authorizer) Endpoints {
+	endpoints := Endpoints{
+		GetAdEndpoint:       MakeGetAdEndpoint(service),
+		ListAdsEndpoint:     MakeListAdsEndpoint(service),
+		SearchAdsEndpoint:   MakeSearchAdsEndpoint(service),
 		PostAdEndpoint:      MakePostAdEndpoint(service),
 		PutAdEndpoint:       MakePutAdEndpoint(service),
 		DeleteAdEndpoint:    MakeDeleteAdEndpoint(service),
+		GetPhotoEndpoint:    MakeGetPhotoEndpoint(service),
 		PostPhotoEndpoint:   MakePostPhotoEndpoint(service),
+		PostPhotosEndpoint:  MakePostPhotosEndpoint(service),
 		DeletePhotoEndpoint: MakeDeletePhotoEndpoint(service),
+		WatchPhotoEndpoint:  MakeWatchPhotoEndpoint(service),
+
+		ReorderPhotosEndpoint: MakeReorderPhotosEndpoint(service),
+		SetCoverPhotoEndpoint: MakeSetCoverPhotoEndpoint(service),
+
+		CreateUploadURLEndpoint: MakeCreateUploadURLEndpoint(service),
+		ConfirmUploadEndpoint:   MakeConfirmUploadEndpoint(service),
+		PutSignedUploadEndpoint: MakePutSignedUploadEndpoint(service),
+
+		CreateUploadEndpoint:   MakeCreateUploadEndpoint(service),
+		GetUploadEndpoint:      MakeGetUploadEndpoint(service),
+		PatchUploadEndpoint:    MakePatchUploadEndpoint(service),
+		FinalizeUploadEndpoint: MakeFinalizeUploadEndpoint(service),
+		DeleteUploadEndpoint:   MakeDeleteUploadEndpoint(service),
+
+		ListProcessingJobsEndpoint:  MakeListProcessingJobsEndpoint(service),
+		ReplayProcessingJobEndpoint: MakeReplayProcessingJobEndpoint(service),
+
+		GetUsageEndpoint: MakeGetUsageEndpoint(service),
+
+		CreateAPIKeyEndpoint: MakeCreateAPIKeyEndpoint(service),
+		ListAPIKeysEndpoint:  MakeListAPIKeysEndpoint(service),
+		RotateAPIKeyEndpoint: MakeRotateAPIKeyEndpoint(service),
+		RevokeAPIKeyEndpoint: MakeRevokeAPIKeyEndpoint(service),
+	}
+
+	endpoints.PostAdEndpoint = authorizer.Require(ActionAdCreate)(endpoints.PostAdEndpoint)
+	endpoints.PutAdEndpoint = authorizer.Require(ActionAdWrite)(endpoints.PutAdEndpoint)
+	endpoints.DeleteAdEndpoint = authorizer.Require(ActionAdDelete)(endpoints.DeleteAdEndpoint)
+	for _, e := range []*endpoint.Endpoint{
+		&endpoints.PostPhotoEndpoint,
+		&endpoints.PostPhotosEndpoint,
+		&endpoints.ReorderPhotosEndpoint,
+		&endpoints.SetCoverPhotoEndpoint,
+		&endpoints.CreateUploadURLEndpoint,
+		&endpoints.ConfirmUploadEndpoint,
+		&endpoints.CreateUploadEndpoint,
+		&endpoints.GetUploadEndpoint,
+		&endpoints.PatchUploadEndpoint,
+		&endpoints.FinalizeUploadEndpoint,
+		&endpoints.DeleteUploadEndpoint,
+	} {
+		*e = authorizer.Require(ActionPhotoWrite)(*e)
+	}
+	endpoints.DeletePhotoEndpoint = authorizer.Require(ActionPhotoDelete)(endpoints.DeletePhotoEndpoint)
+	endpoints.ListProcessingJobsEndpoint = authorizer.Require(ActionJobRead)(endpoints.ListProcessingJobsEndpoint)
+	endpoints.ReplayProcessingJobEndpoint = authorizer.Require(ActionJobReplay)(endpoints.ReplayProcessingJobEndpoint)
+	endpoints.GetUsageEndpoint = authorizer.Require(ActionUsageRead)(endpoints.GetUsageEndpoint)
+	for _, e := range []*endpoint.Endpoint{
+		&endpoints.CreateAPIKeyEndpoint,
+		&endpoints.ListAPIKeysEndpoint,
+		&endpoints.RotateAPIKeyEndpoint,
+		&endpoints.RevokeAPIKeyEndpoint,
+	} {
+		*e = authorizer.Require(ActionAPIKeyManage)(*e)
+	}
+	return endpoints
+}
+
+func MakeGetAdEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getAdRequest)
+		ad, photos, err := service.GetAd(ctx, req.ID)
+		return getAdResponse{Ad: ad, Photos: photos, Err: err}, nil
+	}
+}
+
+func MakeListAdsEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(listAdsRequest)
+		ads, next, err := service.ListAds(ctx, req.Query)
+		return listAdsResponse{Ads: ads, NextCursor: next, Err: err}, nil
+	}
+}
+
+func MakeSearchAdsEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(searchAdsRequest)
+		hits, next, err := service.SearchAds(ctx, req.Query)
+		return searchAdsResponse{Hits: hits, NextCursor: next, Err: err}, nil
 	}
 }
 
@@ -59,14 +179,160 @@ func MakeDeleteAdEndpoint(service Service) endpoint.Endpoint {
 	}
 }
 
+func MakeGetPhotoEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getPhotoRequest)
+		photo, err := service.GetPhoto(ctx, req.AdID, req.ID)
+		return getPhotoResponse{Photo: photo, Err: err}, nil
+	}
+}
+
 func MakePostPhotoEndpoint(service Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(postPhotoRequest)
-		photo, err := service.PostPhoto(ctx, req.AdID, req.File)
+		photo, err := service.PostPhoto(ctx, req.AdID, req.File, req.OnDuplicate)
+		if err != nil {
+			return postPhotoResponse{Err: err}, nil
+		}
+		return postPhotoResponse{
+			IdPhoto:   photo.IdPhoto,
+			Url:       photo.UrlOriginal,
+			Status:    photo.Status,
+			Variants:  photo.Variants,
+			Duplicate: photo.Duplicate,
+			Err:       err,
+		}, nil
+	}
+}
+
+func MakePostPhotosEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(postPhotosRequest)
+		results, err := service.PostPhotos(ctx, req.AdID, req.Uploads, req.OnDuplicate)
+		if err != nil {
+			return postPhotosResponse{Err: err}, nil
+		}
+		response := postPhotosResponse{Results: make([]postPhotosResult, len(results))}
+		for i, result := range results {
+			item := postPhotosResult{Name: result.Name}
+			if result.Err != nil {
+				item.Error = result.Err.Error()
+				item.Code = httpErrCode(result.Err)
+			} else {
+				item.IdPhoto = result.Photo.IdPhoto
+				item.Url = result.Photo.UrlOriginal
+				item.Status = result.Photo.Status
+				item.Variants = result.Photo.Variants
+				item.Duplicate = result.Photo.Duplicate
+			}
+			response.Results[i] = item
+		}
+		return response, nil
+	}
+}
+
+func MakeCreateUploadURLEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(createUploadURLRequest)
+		upload, err := service.CreateUploadURL(ctx, req.AdID, req.ContentType)
+		return createUploadURLResponse{UploadURL: upload, Err: err}, nil
+	}
+}
+
+func MakeConfirmUploadEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(confirmUploadRequest)
+		photo, err := service.ConfirmUpload(ctx, req.AdID, req.ObjectName, req.OnDuplicate)
+		if err != nil {
+			return postPhotoResponse{Err: err}, nil
+		}
+		return postPhotoResponse{
+			IdPhoto:   photo.IdPhoto,
+			Url:       photo.UrlOriginal,
+			Status:    photo.Status,
+			Variants:  photo.Variants,
+			Duplicate: photo.Duplicate,
+		}, nil
+	}
+}
+
+func MakePutSignedUploadEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(putSignedUploadRequest)
+		err := service.PutSignedUpload(ctx, req.Upload, req.Body)
+		return putSignedUploadResponse{Err: err}, nil
+	}
+}
+
+func MakeCreateUploadEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(createUploadRequest)
+		upload, err := service.CreateUpload(ctx, req.AdID, req.Length)
+		if err != nil {
+			return uploadResponse{Err: err}, nil
+		}
+		return uploadResponse{
+			UploadSession: upload,
+			Location:      req.Path + "/" + upload.IdUpload,
+			Code:          http.StatusCreated,
+		}, nil
+	}
+}
+
+func MakeGetUploadEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(uploadRequest)
+		upload, err := service.GetUpload(ctx, req.AdID, req.ID)
+		return uploadResponse{UploadSession: upload, Code: http.StatusOK, Err: err}, nil
+	}
+}
+
+func MakePatchUploadEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(patchUploadRequest)
+		upload, err := service.PatchUpload(ctx, req.AdID, req.ID, req.Offset, req.Body)
+		return uploadResponse{UploadSession: upload, Code: http.StatusNoContent, Err: err}, nil
+	}
+}
+
+func MakeFinalizeUploadEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(finalizeUploadRequest)
+		photo, err := service.FinalizeUpload(ctx, req.AdID, req.ID, req.OnDuplicate)
 		if err != nil {
 			return postPhotoResponse{Err: err}, nil
 		}
-		return postPhotoResponse{IdPhoto: photo.IdPhoto, Url: photo.UrlOriginal, Err: err}, nil
+		return postPhotoResponse{
+			IdPhoto:   photo.IdPhoto,
+			Url:       photo.UrlOriginal,
+			Status:    photo.Status,
+			Variants:  photo.Variants,
+			Duplicate: photo.Duplicate,
+		}, nil
+	}
+}
+
+func MakeDeleteUploadEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(uploadRequest)
+		err := service.DeleteUpload(ctx, req.AdID, req.ID)
+		return uploadResponse{Code: http.StatusNoContent, Err: err}, nil
+	}
+}
+
+func MakeReorderPhotosEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(reorderPhotosRequest)
+		photos, err := service.ReorderPhotos(ctx, req.AdID, req.PhotoIDs)
+		return reorderPhotosResponse{Photos: photos, Err: err}, nil
+	}
+}
+
+func MakeSetCoverPhotoEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(setCoverPhotoRequest)
+		photo, err := service.SetCoverPhoto(ctx, req.AdID, req.ID)
+		return getPhotoResponse{Photo: photo, Err: err}, nil
 	}
 }
 
@@ -78,6 +344,69 @@ func MakeDeletePhotoEndpoint(service Service) endpoint.Endpoint {
 	}
 }
 
+func MakeWatchPhotoEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(watchPhotoRequest)
+		events, err := service.WatchPhoto(ctx, req.AdID, req.ID)
+		return watchPhotoResponse{Events: events, Err: err}, nil
+	}
+}
+
+func MakeListProcessingJobsEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(listProcessingJobsRequest)
+		jobs, next, err := service.ListProcessingJobs(ctx, req.Query)
+		return listProcessingJobsResponse{Jobs: jobs, NextCursor: next, Err: err}, nil
+	}
+}
+
+func MakeReplayProcessingJobEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(replayProcessingJobRequest)
+		job, err := service.ReplayProcessingJob(ctx, req.ID)
+		return replayProcessingJobResponse{ProcessingJob: job, Err: err}, nil
+	}
+}
+
+func MakeGetUsageEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getUsageRequest)
+		usage, err := service.GetUsage(ctx, req.IdUser)
+		return getUsageResponse{Usage: usage, Err: err}, nil
+	}
+}
+
+func MakeCreateAPIKeyEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(createAPIKeyRequest)
+		key, secret, err := service.CreateAPIKey(ctx, req.Key)
+		return apiKeyResponse{APIKey: key, Key: secret, Code: http.StatusCreated, Err: err}, nil
+	}
+}
+
+func MakeListAPIKeysEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		keys, err := service.ListAPIKeys(ctx)
+		return listAPIKeysResponse{Keys: keys, Err: err}, nil
+	}
+}
+
+func MakeRotateAPIKeyEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(apiKeyRequest)
+		key, secret, err := service.RotateAPIKey(ctx, req.ID)
+		return apiKeyResponse{APIKey: key, Key: secret, Code: http.StatusOK, Err: err}, nil
+	}
+}
+
+func MakeRevokeAPIKeyEndpoint(service Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(apiKeyRequest)
+		err := service.RevokeAPIKey(ctx, req.ID)
+		return revokeAPIKeyResponse{Err: err}, nil
+	}
+}
+
 // We have two options to return errors from the business logic.
 //
 // We could return the error via the endpoint itself. That makes certain things
@@ -93,6 +422,45 @@ func MakeDeletePhotoEndpoint(service Service) endpoint.Endpoint {
 // Response types that may contain business-logic errors implement that
 // interface.
 
+type getAdRequest struct {
+	ID uint
+}
+type getAdResponse struct {
+	*Ad
+	Photos []Photo `json:"photos,omitempty"`
+	Err    error   `json:"err,omitempty"`
+}
+
+func (r getAdResponse) error() error {
+	return r.Err
+}
+
+type listAdsRequest struct {
+	Query AdQuery
+}
+type listAdsResponse struct {
+	Ads        []Ad   `json:"ads"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	Err        error  `json:"err,omitempty"`
+}
+
+func (r listAdsResponse) error() error {
+	return r.Err
+}
+
+type searchAdsRequest struct {
+	Query AdSearchQuery
+}
+type searchAdsResponse struct {
+	Hits       []AdSearchHit `json:"hits"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+	Err        error         `json:"err,omitempty"`
+}
+
+func (r searchAdsResponse) error() error {
+	return r.Err
+}
+
 type postAdRequest struct {
 	Ad Ad
 }
@@ -127,20 +495,195 @@ func (r deleteAdResponse) error() error {
 	return r.Err
 }
 
-type postPhotoRequest struct {
+type getPhotoRequest struct {
 	AdID uint
-	File multipart.File
+	ID   uint
+}
+type getPhotoResponse struct {
+	*Photo
+	Err error `json:"err,omitempty"`
+}
+
+func (r getPhotoResponse) error() error {
+	return r.Err
+}
+
+type postPhotoRequest struct {
+	AdID        uint
+	File        multipart.File
+	OnDuplicate string
 }
 type postPhotoResponse struct {
-	IdPhoto uint   `json:"id_photo"`
-	Url     string `json:"url"`
-	Err     error  `json:"err,omitempty"`
+	IdPhoto  uint           `json:"id_photo"`
+	Url      string         `json:"url"`
+	Status   string         `json:"status,omitempty"`
+	Variants []PhotoVariant `json:"variants"`
+	// Duplicate is set when the ad already had the photo.
+	Duplicate bool  `json:"duplicate,omitempty"`
+	Err       error `json:"err,omitempty"`
 }
 
 func (r postPhotoResponse) error() error {
 	return r.Err
 }
 
+// StatusCode answers 202 Accepted for photos that are not processed yet.
+// Duplicates answer 200 OK, as nothing was accepted.
+func (r postPhotoResponse) StatusCode() int {
+	if r.Status != PhotoStatusReady && !r.Duplicate {
+		return http.StatusAccepted
+	}
+	return http.StatusOK
+}
+
+type postPhotosRequest struct {
+	AdID        uint
+	Uploads     []PhotoUpload
+	OnDuplicate string
+}
+type postPhotosResponse struct {
+	Results []postPhotosResult `json:"results"`
+	Err     error              `json:"err,omitempty"`
+}
+
+// postPhotosResult is a postPhotoResponse for one photo of a batch, or the
+// error message and HTTP status that uploading it alone would have given.
+type postPhotosResult struct {
+	Name      string         `json:"name"`
+	IdPhoto   uint           `json:"id_photo,omitempty"`
+	Url       string         `json:"url,omitempty"`
+	Status    string         `json:"status,omitempty"`
+	Variants  []PhotoVariant `json:"variants,omitempty"`
+	Duplicate bool           `json:"duplicate,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Code      int            `json:"code,omitempty"`
+}
+
+func (r postPhotosResponse) error() error {
+	return r.Err
+}
+
+// StatusCode answers 207 Multi-Status when some photo failed, and otherwise
+// like postPhotoResponse: 202 Accepted if some photo is not processed yet.
+func (r postPhotosResponse) StatusCode() int {
+	code := http.StatusOK
+	for _, result := range r.Results {
+		if result.Error != "" {
+			return http.StatusMultiStatus
+		}
+		if result.Status != PhotoStatusReady && !result.Duplicate {
+			code = http.StatusAccepted
+		}
+	}
+	return code
+}
+
+type createUploadURLRequest struct {
+	AdID        uint
+	ContentType string `json:"content_type"`
+}
+type createUploadURLResponse struct {
+	*UploadURL
+	Err error `json:"err,omitempty"`
+}
+
+func (r createUploadURLResponse) error() error {
+	return r.Err
+}
+
+// confirmUploadRequest is answered with a postPhotoResponse.
+type confirmUploadRequest struct {
+	AdID        uint
+	ObjectName  string `json:"object_name"`
+	OnDuplicate string
+}
+
+type putSignedUploadRequest struct {
+	Upload SignedUpload
+	Body   io.Reader
+}
+type putSignedUploadResponse struct {
+	Err error `json:"err,omitempty"`
+}
+
+func (r putSignedUploadResponse) error() error {
+	return r.Err
+}
+
+type createUploadRequest struct {
+	AdID   uint
+	Length int64
+	// Path is the URL path the upload was created at, which its own is
+	// below.
+	Path string
+}
+type uploadRequest struct {
+	AdID uint
+	ID   string
+}
+type patchUploadRequest struct {
+	AdID   uint
+	ID     string
+	Offset int64
+	Body   io.Reader
+}
+type finalizeUploadRequest struct {
+	AdID        uint
+	ID          string
+	OnDuplicate string
+}
+
+// uploadResponse carries the state of a resumable upload in the headers of
+// the tus protocol as well as in its body.
+type uploadResponse struct {
+	*UploadSession
+	Location string `json:"-"`
+	Code     int    `json:"-"`
+	Err      error  `json:"err,omitempty"`
+}
+
+func (r uploadResponse) error() error {
+	return r.Err
+}
+
+func (r uploadResponse) StatusCode() int {
+	return r.Code
+}
+
+func (r uploadResponse) Headers() http.Header {
+	// Tus-Resumable is set by tusHeaders, for errors as well.
+	headers := http.Header{}
+	if r.Location != "" {
+		headers.Set("Location", r.Location)
+	}
+	if r.UploadSession != nil {
+		headers.Set("Upload-Offset", strconv.FormatInt(r.Offset, 10))
+		headers.Set("Upload-Length", strconv.FormatInt(r.Length, 10))
+		headers.Set("Upload-Expires", r.ExpiresAt.UTC().Format(http.TimeFormat))
+		headers.Set("Cache-Control", "no-store")
+	}
+	return headers
+}
+
+type reorderPhotosRequest struct {
+	AdID     uint
+	PhotoIDs []uint `json:"photo_ids"`
+}
+type reorderPhotosResponse struct {
+	Photos []Photo `json:"photos"`
+	Err    error   `json:"err,omitempty"`
+}
+
+func (r reorderPhotosResponse) error() error {
+	return r.Err
+}
+
+// setCoverPhotoRequest is answered with a getPhotoResponse.
+type setCoverPhotoRequest struct {
+	AdID uint
+	ID   uint
+}
+
 type deletePhotoRequest struct {
 	AdID uint
 	ID   uint
@@ -152,3 +695,93 @@ type deletePhotoResponse struct {
 func (r deletePhotoResponse) error() error {
 	return r.Err
 }
+
+type watchPhotoRequest struct {
+	AdID uint
+	ID   uint
+}
+type watchPhotoResponse struct {
+	Events <-chan PhotoProgress
+	Err    error
+}
+
+func (r watchPhotoResponse) error() error {
+	return r.Err
+}
+
+type listProcessingJobsRequest struct {
+	Query JobQuery
+}
+type listProcessingJobsResponse struct {
+	Jobs       []ProcessingJob `json:"jobs"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+	Err        error           `json:"err,omitempty"`
+}
+
+func (r listProcessingJobsResponse) error() error {
+	return r.Err
+}
+
+type replayProcessingJobRequest struct {
+	ID uint
+}
+type replayProcessingJobResponse struct {
+	*ProcessingJob
+	Err error `json:"err,omitempty"`
+}
+
+func (r replayProcessingJobResponse) error() error {
+	return r.Err
+}
+
+type getUsageRequest struct {
+	IdUser string
+}
+type getUsageResponse struct {
+	*Usage
+	Err error `json:"err,omitempty"`
+}
+
+func (r getUsageResponse) error() error {
+	return r.Err
+}
+
+type createAPIKeyRequest struct {
+	Key APIKey
+}
+type apiKeyRequest struct {
+	ID uint
+}
+
+// apiKeyResponse carries the key itself, which is only ever shown here.
+type apiKeyResponse struct {
+	*APIKey
+	Key  string `json:"key,omitempty"`
+	Code int    `json:"-"`
+	Err  error  `json:"err,omitempty"`
+}
+
+func (r apiKeyResponse) error() error {
+	return r.Err
+}
+
+func (r apiKeyResponse) StatusCode() int {
+	return r.Code
+}
+
+type listAPIKeysResponse struct {
+	Keys []APIKey `json:"keys"`
+	Err  error    `json:"err,omitempty"`
+}
+
+func (r listAPIKeysResponse) error() error {
+	return r.Err
+}
+
+type revokeAPIKeyResponse struct {
+	Err error `json:"err,omitempty"`
+}
+
+func (r revokeAPIKeyResponse) error() error {
+	return r.Err
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+var errInvalidExif = errors.New("invalid exif data")
+
+const (
+	exifTagOrientation = 0x0112
+	exifTagExifIFD     = 0x8769
+	exifTagGPSIFD      = 0x8825
+)
+
+// EXIF tags that may be kept, by name, in IFD0 and in the Exif sub-IFD.
+// Location tags live in the GPS IFD, which is never kept.
+var (
+	exifIFD0Tags = map[string]uint16{
+		"ImageDescription": 0x010e,
+		"Make":             0x010f,
+		"Model":            0x0110,
+		"Software":         0x0131,
+		"DateTime":         0x0132,
+		"Artist":           0x013b,
+		"Copyright":        0x8298,
+	}
+	exifSubIFDTags = map[string]uint16{
+		"ExposureTime":      0x829a,
+		"FNumber":           0x829d,
+		"ISOSpeedRatings":   0x8827,
+		"DateTimeOriginal":  0x9003,
+		"DateTimeDigitized": 0x9004,
+		"FocalLength":       0x920a,
+		"LensMake":          0xa433,
+		"LensModel":         0xa434,
+	}
+)
+
+// exifTypeSizes are the sizes of the TIFF field types, by type.
+var exifTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// exifData holds the entries of IFD0 and the Exif sub-IFD of a TIFF
+// structure, as found in EXIF metadata.
+type exifData struct {
+	order  binary.ByteOrder
+	ifd0   []exifEntry
+	subIFD []exifEntry
+}
+
+// parseExif parses TIFF data, i.e. EXIF metadata without its "Exif\0\0"
+// prefix.
+func parseExif(tiff []byte) (*exifData, error) {
+	if len(tiff) < 8 {
+		return nil, errInvalidExif
+	}
+	exif := &exifData{}
+	switch string(tiff[0:2]) {
+	case "II":
+		exif.order = binary.LittleEndian
+	case "MM":
+		exif.order = binary.BigEndian
+	default:
+		return nil, errInvalidExif
+	}
+	if exif.order.Uint16(tiff[2:4]) != 42 {
+		return nil, errInvalidExif
+	}
+	var err error
+	if exif.ifd0, err = exif.readIFD(tiff, exif.order.Uint32(tiff[4:8])); err != nil {
+		return nil, err
+	}
+	for _, entry := range exif.ifd0 {
+		if entry.tag == exifTagExifIFD && len(entry.value) == 4 {
+			// A broken sub-IFD only costs its tags.
+			exif.subIFD, _ = exif.readIFD(tiff, exif.order.Uint32(entry.value))
+		}
+	}
+	return exif, nil
+}
+
+func (e *exifData) readIFD(tiff []byte, offset uint32) ([]exifEntry, error) {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return nil, errInvalidExif
+	}
+	count := uint32(e.order.Uint16(tiff[offset:]))
+	if uint64(offset)+2+uint64(count)*12 > uint64(len(tiff)) {
+		return nil, errInvalidExif
+	}
+	entries := []exifEntry{}
+	for i := uint32(0); i < count; i++ {
+		raw := tiff[offset+2+i*12 : offset+2+(i+1)*12]
+		entry := exifEntry{
+			tag:   e.order.Uint16(raw[0:2]),
+			typ:   e.order.Uint16(raw[2:4]),
+			count: e.order.Uint32(raw[4:8]),
+		}
+		size, ok := exifTypeSizes[entry.typ]
+		if !ok {
+			continue
+		}
+		length := uint64(size) * uint64(entry.count)
+		if length <= 4 {
+			entry.value = raw[8 : 8+length]
+		} else {
+			start := uint64(e.order.Uint32(raw[8:12]))
+			if start+length > uint64(len(tiff)) {
+				continue
+			}
+			entry.value = tiff[start : start+length]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Orientation returns the orientation tag, 1 to 8, or 1 if it is missing.
+func (e *exifData) Orientation() int {
+	for _, entry := range e.ifd0 {
+		if entry.tag == exifTagOrientation && entry.typ == 3 && len(entry.value) >= 2 {
+			if orientation := int(e.order.Uint16(entry.value)); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+		}
+	}
+	return 1
+}
+
+// Filter returns TIFF data holding only the allowed tags, and the
+// orientation if keepOrientation is set. empty tells whether no tag was
+// kept.
+func (e *exifData) Filter(allow MetadataAllowList, keepOrientation bool) (tiff []byte, empty bool) {
+	ifd0 := []exifEntry{}
+	for _, entry := range e.ifd0 {
+		if allow.exifTags[entry.tag] || keepOrientation && entry.tag == exifTagOrientation {
+			ifd0 = append(ifd0, entry)
+		}
+	}
+	subIFD := []exifEntry{}
+	for _, entry := range e.subIFD {
+		if allow.exifSubIFDTags[entry.tag] {
+			subIFD = append(subIFD, entry)
+		}
+	}
+	if len(subIFD) > 0 {
+		// Points to the sub-IFD once its offset is known.
+		ifd0 = append(ifd0, exifEntry{tag: exifTagExifIFD, typ: 4, count: 1, value: make([]byte, 4)})
+	}
+	sort.Slice(ifd0, func(i, j int) bool { return ifd0[i].tag < ifd0[j].tag })
+	sort.Slice(subIFD, func(i, j int) bool { return subIFD[i].tag < subIFD[j].tag })
+
+	buf := &bytes.Buffer{}
+	if e.order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	binary.Write(buf, e.order, uint16(42))
+	binary.Write(buf, e.order, uint32(8))
+	subOffset := 8 + exifIFDSize(ifd0)
+	for i := range ifd0 {
+		if ifd0[i].tag == exifTagExifIFD {
+			e.order.PutUint32(ifd0[i].value, subOffset)
+		}
+	}
+	e.writeIFD(buf, ifd0, 8)
+	if len(subIFD) > 0 {
+		e.writeIFD(buf, subIFD, subOffset)
+	}
+	return buf.Bytes(), len(ifd0) == 0
+}
+
+// exifIFDSize is the size of an IFD along with the values stored after it.
+func exifIFDSize(entries []exifEntry) uint32 {
+	size := 2 + 12*uint32(len(entries)) + 4
+	for _, entry := range entries {
+		if len(entry.value) > 4 {
+			size += uint32(len(entry.value)+1) &^ 1
+		}
+	}
+	return size
+}
+
+// writeIFD writes an IFD located at offset, followed by the values that do
+// not fit into its entries.
+func (e *exifData) writeIFD(buf *bytes.Buffer, entries []exifEntry, offset uint32) {
+	dataOffset := offset + 2 + 12*uint32(len(entries)) + 4
+	data := &bytes.Buffer{}
+	binary.Write(buf, e.order, uint16(len(entries)))
+	for _, entry := range entries {
+		binary.Write(buf, e.order, entry.tag)
+		binary.Write(buf, e.order, entry.typ)
+		binary.Write(buf, e.order, entry.count)
+		if len(entry.value) <= 4 {
+			value := make([]byte, 4)
+			copy(value, entry.value)
+			buf.Write(value)
+			continue
+		}
+		binary.Write(buf, e.order, dataOffset+uint32(data.Len()))
+		data.Write(entry.value)
+		if data.Len()%2 == 1 {
+			data.WriteByte(0)
+		}
+	}
+	binary.Write(buf, e.order, uint32(0))
+	buf.Write(data.Bytes())
+}
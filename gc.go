@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"gorm.io/gorm"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ErrEmptyBlobStore is returned by Collect when the blob store holds no
+// objects at all while there are photos.
+var ErrEmptyBlobStore = errors.New("blob store is empty but photos exist, not deleting them")
+
+// photoObjectName matches the names PostPhoto gives originals,
+// "{adId}-{nanos}", and captures that part of the names of derived variants.
+// Content-addressed names are matched by contentObjectName, those of signed
+// uploads awaiting confirmation by stagedObjectName and chunks of resumable
+// uploads by uploadChunkObjectName.
+var photoObjectName = regexp.MustCompile(`^([0-9]+)-([0-9]+)`)
+
+// OrphanReport lists what a garbage collection found.
+type OrphanReport struct {
+	DryRun bool `json:"dry_run"`
+	// OrphanBlobs are stored objects no photo row refers to.
+	OrphanBlobs []BlobInfo `json:"orphan_blobs"`
+	// OrphanPhotos are photo rows whose original object is missing.
+	OrphanPhotos []Photo `json:"orphan_photos"`
+}
+
+// GarbageCollector reconciles the blob store with t_photo. Anything younger
+// than gracePeriod is left alone, since PostPhoto writes the blob before the
+// row and an upload may be in flight.
+type GarbageCollector struct {
+	logger      log.Logger
+	db          *gorm.DB
+	blobStore   BlobStore
+	blobPurger  *BlobPurger
+	gracePeriod time.Duration
+}
+
+func NewGarbageCollector(logger log.Logger, db *gorm.DB, blobStore BlobStore, gracePeriod time.Duration) *GarbageCollector {
+	return &GarbageCollector{
+		logger:      log.With(logger, "component", "GarbageCollector"),
+		db:          db,
+		blobStore:   blobStore,
+		blobPurger:  NewBlobPurger(logger, db, blobStore),
+		gracePeriod: gracePeriod,
+	}
+}
+
+// Collect finds orphaned blobs and photo rows and, unless dryRun is set,
+// deletes them.
+func (gc *GarbageCollector) Collect(ctx context.Context, dryRun bool) (*OrphanReport, error) {
+	cutoff := time.Now().Add(-gc.gracePeriod)
+	report := &OrphanReport{DryRun: dryRun, OrphanBlobs: []BlobInfo{}, OrphanPhotos: []Photo{}}
+
+	photos := []Photo{}
+	if result := gc.db.Preload("Variants").Select("id_photo", "id_ad", "url_original", "object_name", "created_at").Find(&photos); result.Error != nil {
+		return nil, result.Error
+	}
+	known := map[string]bool{}
+	for _, photo := range photos {
+		known[photo.ObjectName] = true
+		for _, variant := range photo.Variants {
+			known[variant.ObjectName] = true
+		}
+	}
+	// Objects already queued for deletion are the purger's business.
+	queued := []string{}
+	if result := gc.db.Model(&BlobDeletion{}).Pluck("object_name", &queued); result.Error != nil {
+		return nil, result.Error
+	}
+	for _, name := range queued {
+		known[name] = true
+	}
+	chunks := []string{}
+	if result := gc.db.Model(&UploadChunk{}).Pluck("object_name", &chunks); result.Error != nil {
+		return nil, result.Error
+	}
+	for _, name := range chunks {
+		known[name] = true
+	}
+
+	blobs, err := gc.blobStore.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(blobs) == 0 && len(photos) > 0 && !dryRun {
+		// Most likely the wrong bucket or directory, which would make
+		// every photo an orphan.
+		return nil, ErrEmptyBlobStore
+	}
+	originals := map[string]bool{}
+	for _, blob := range blobs {
+		base := photoObjectName.FindString(blob.Name)
+		if base == "" {
+			base = contentObjectName.FindString(blob.Name)
+		}
+		if base == "" && (stagedObjectName.MatchString(blob.Name) || uploadChunkObjectName.MatchString(blob.Name)) {
+			// Signed uploads that were never confirmed, and chunks of
+			// resumable uploads that are gone.
+			base = blob.Name
+		}
+		if base == "" {
+			continue
+		}
+		if base == blob.Name {
+			originals[base] = true
+		}
+		if !known[base] && !known[blob.Name] && blob.Updated.Before(cutoff) {
+			report.OrphanBlobs = append(report.OrphanBlobs, blob)
+		}
+	}
+
+	for _, photo := range photos {
+		if originals[photo.ObjectName] {
+			continue
+		}
+		uploaded, ok := objectNameTime(photo.ObjectName)
+		if !ok && contentObjectName.MatchString(photo.ObjectName) {
+			// Content-addressed names carry no time.
+			uploaded, ok = photo.CreatedAt, true
+		}
+		if ok && uploaded.Before(cutoff) {
+			report.OrphanPhotos = append(report.OrphanPhotos, photo)
+		}
+	}
+
+	for _, blob := range report.OrphanBlobs {
+		level.Info(gc.logger).Log("context", "Collect", "msg", "Orphaned blob", "object", blob.Name, "dry-run", dryRun)
+	}
+	for _, photo := range report.OrphanPhotos {
+		level.Info(gc.logger).Log("context", "Collect", "msg", "Orphaned photo", "id", photo.IdPhoto, "object", photo.ObjectName, "dry-run", dryRun)
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	// Removed like queued deletions, so a content-addressed blob an upload
+	// just started sharing again is kept.
+	for _, blob := range report.OrphanBlobs {
+		if err := gc.blobPurger.remove(ctx, BlobDeletion{ObjectName: blob.Name}); err != nil {
+			level.Error(gc.logger).Log("context", "Collect", "object", blob.Name, "msg", err)
+		}
+	}
+	if len(report.OrphanPhotos) > 0 {
+		deletions := photoBlobDeletions(report.OrphanPhotos)
+		affected := map[uint]bool{}
+		for _, photo := range report.OrphanPhotos {
+			affected[photo.IdAd] = true
+		}
+		adIds := make([]uint, 0, len(affected))
+		for adId := range affected {
+			adIds = append(adIds, adId)
+		}
+		// Locked in order, so two collections cannot deadlock.
+		sort.Slice(adIds, func(i, j int) bool { return adIds[i] < adIds[j] })
+		err := gc.db.Transaction(func(tx *gorm.DB) error {
+			for _, adId := range adIds {
+				if err := lockAd(tx, adId); err != nil {
+					return err
+				}
+			}
+			if result := tx.Delete(&report.OrphanPhotos); result.Error != nil {
+				return result.Error
+			}
+			// Ads whose cover was deleted get a new one, as in DeletePhoto.
+			for _, adId := range adIds {
+				var covers int64
+				if result := tx.Model(&Photo{}).Where("id_ad = ? AND cover", adId).Count(&covers); result.Error != nil {
+					return result.Error
+				}
+				if covers == 0 {
+					if err := promoteCover(tx, adId); err != nil {
+						return err
+					}
+				}
+			}
+			if len(deletions) > 0 {
+				return tx.Create(&deletions).Error
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		gc.blobPurger.Purge(ctx, deletions)
+	}
+	return report, nil
+}
+
+// objectNameTime returns the upload time embedded in a photo object name.
+func objectNameTime(name string) (time.Time, bool) {
+	match := photoObjectName.FindStringSubmatch(name)
+	if match == nil {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(match[2], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// Run collects garbage every interval until ctx is done.
+func (gc *GarbageCollector) Run(ctx context.Context, interval time.Duration, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		report, err := gc.Collect(ctx, dryRun)
+		if err != nil {
+			level.Error(gc.logger).Log("context", "Run", "msg", err)
+			continue
+		}
+		level.Info(gc.logger).Log("context", "Run", "msg", "Garbage collection finished",
+			"orphan-blobs", len(report.OrphanBlobs), "orphan-photos", len(report.OrphanPhotos), "dry-run", dryRun)
+	}
+}
+
+// runGarbageCollection implements the "gc" subcommand, which runs a single
+// collection and writes the report to out as JSON. Orphans are only
+// deleted with -delete.
+func runGarbageCollection(ctx context.Context, logger log.Logger, db *gorm.DB, blobStore BlobStore, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	remove := flags.Bool("delete", false, "delete orphans instead of only reporting them")
+	grace := flags.Duration("grace", time.Hour, "ignore blobs and photos younger than this")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if blobStore == nil {
+		return errors.New("blob store not available")
+	}
+	report, err := NewGarbageCollector(logger, db, blobStore, *grace).Collect(ctx, !*remove)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// dryRunDB returns a database that runs no statements, and cannot begin
+// transactions as nothing listens at its address.
+func dryRunDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(postgres.Open("host=127.0.0.1 port=1 user=test dbname=test sslmode=disable connect_timeout=1"), &gorm.Config{
+		DryRun:                 true,
+		SkipDefaultTransaction: true,
+		DisableAutomaticPing:   true,
+		Logger:                 logger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// withRows makes queries of db into a value of the type of rows find rows.
+func withRows(t *testing.T, db *gorm.DB, rows interface{}) {
+	value := reflect.ValueOf(rows)
+	err := db.Callback().Query().Before("gorm:preload").Register("test:rows:"+value.Type().String(), func(tx *gorm.DB) {
+		dest := reflect.ValueOf(tx.Statement.Dest)
+		if dest.Kind() == reflect.Ptr && dest.Elem().Type() == value.Type() {
+			dest.Elem().Set(value)
+			tx.RowsAffected = 1
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGarbageCollectionCommand(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("reports only by default", func(t *testing.T) {
+		store := NewMemoryBlobStore("http://cdn.test/photos/")
+		if err := store.Put(ctx, "1-1", bytes.NewReader(testPNG), "image/png"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+		out := &bytes.Buffer{}
+		if err := runGarbageCollection(ctx, log.NewNopLogger(), dryRunDB(t), store, []string{"-grace", "0s"}, out); err != nil {
+			t.Fatal(err)
+		}
+		var report OrphanReport
+		if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		if !report.DryRun || len(report.OrphanBlobs) != 1 || report.OrphanBlobs[0].Name != "1-1" {
+			t.Errorf("got %+v, want a dry run finding 1-1", report)
+		}
+		if _, err := store.Stat(ctx, "1-1"); err != nil {
+			t.Errorf("orphan deleted: %v", err)
+		}
+	})
+
+	t.Run("refuses to delete everything", func(t *testing.T) {
+		db := dryRunDB(t)
+		withRows(t, db, []Photo{{IdPhoto: 1, IdAd: 1, ObjectName: "1-1"}})
+		err := runGarbageCollection(ctx, log.NewNopLogger(), db, NewMemoryBlobStore("http://cdn.test/photos/"),
+			[]string{"-delete", "-grace", "0s"}, &bytes.Buffer{})
+		if err != ErrEmptyBlobStore {
+			t.Errorf("got %v, want ErrEmptyBlobStore", err)
+		}
+	})
+}
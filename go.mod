@@ -8,6 +8,8 @@ require (
 	github.com/golang/protobuf v1.4.3
 	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/mux v1.7.3
+	github.com/jackc/pgconn v1.8.0
+	github.com/sony/gobreaker v0.5.0
 	github.com/spf13/viper v1.7.1
 	google.golang.org/api v0.36.0
 	google.golang.org/grpc v1.35.0
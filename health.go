@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	HealthOK = "ok"
+	// HealthDegraded means requests are served but some work is deferred,
+	// e.g. photos wait in the outbox while the image processor is down.
+	HealthDegraded    = "degraded"
+	HealthUnavailable = "unavailable"
+)
+
+// Health reports the state of the service and the state of each of its
+// dependencies.
+type Health struct {
+	// Status is one of the Health constants.
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func (s adService) Health(ctx context.Context) Health {
+	health := Health{Status: HealthOK, Checks: map[string]string{}}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	sqlDB, err := s.db.DB()
+	if err == nil {
+		err = sqlDB.PingContext(ctx)
+	}
+	if err != nil {
+		health.Status = HealthUnavailable
+		health.Checks["database"] = err.Error()
+	} else {
+		health.Checks["database"] = HealthOK
+	}
+
+	state, healthy := s.processor.client.Health()
+	health.Checks["image_processor"] = state
+	if !healthy && health.Status == HealthOK {
+		health.Status = HealthDegraded
+	}
+	return health
+}
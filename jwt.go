@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTConfig tells how bearer tokens are verified. Tokens are signed with
+// Secret (HS256, HS384, HS512), or with PublicKey or one of the keys
+// published at JWKSURL (RS256, RS384, RS512, ES256, ES384, ES512).
+type JWTConfig struct {
+	Secret string
+	// PublicKey is a PEM encoded public key or certificate.
+	PublicKey string
+	JWKSURL   string
+	// JWKSRefresh is how often the keys at JWKSURL are fetched again.
+	JWKSRefresh time.Duration
+	// Issuer and Audience, if set, must match the iss and aud claims.
+	Issuer   string
+	Audience string
+	// RolesClaim names the claim listing the caller's roles. Dots separate
+	// the names of nested claims, as in "realm_access.roles".
+	RolesClaim string
+}
+
+// Enabled tells whether a key to verify tokens is configured.
+func (c JWTConfig) Enabled() bool {
+	return c.Secret != "" || c.PublicKey != "" || c.JWKSURL != ""
+}
+
+// Claims are the claims of a verified token.
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	// Roles are read from JWTConfig.RolesClaim.
+	Roles []string `json:"-"`
+}
+
+// audience is the aud claim, which is a string or a list of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// jwtClockSkew is how far the clocks of issuers may be off.
+const jwtClockSkew = time.Minute
+
+type jwtVerifier struct {
+	config JWTConfig
+	secret []byte
+	key    crypto.PublicKey
+	jwks   *jwksCache
+}
+
+func newJWTVerifier(config JWTConfig) (*jwtVerifier, error) {
+	verifier := &jwtVerifier{config: config, secret: []byte(config.Secret)}
+	if config.PublicKey != "" {
+		key, err := parsePublicKey(config.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		verifier.key = key
+	}
+	if config.JWKSURL != "" {
+		verifier.jwks = newJWKSCache(config.JWKSURL, config.JWKSRefresh)
+	}
+	return verifier, nil
+}
+
+func parsePublicKey(data string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("public key is not PEM encoded")
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// Verify checks the signature and claims of a compact serialized token and
+// returns its claims.
+func (v *jwtVerifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+	if err := v.verifySignature(ctx, header.Alg, header.Kid, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	now := time.Now()
+	switch {
+	case claims.Subject == "":
+		return nil, errors.New("token has no subject")
+	case claims.ExpiresAt == 0:
+		return nil, errors.New("token does not expire")
+	case now.Add(-jwtClockSkew).After(time.Unix(claims.ExpiresAt, 0)):
+		return nil, errors.New("token expired")
+	case claims.NotBefore != 0 && now.Add(jwtClockSkew).Before(time.Unix(claims.NotBefore, 0)):
+		return nil, errors.New("token not valid yet")
+	case v.config.Issuer != "" && claims.Issuer != v.config.Issuer:
+		return nil, fmt.Errorf("token issuer %q not accepted", claims.Issuer)
+	case v.config.Audience != "" && !claims.Audience.contains(v.config.Audience):
+		return nil, errors.New("token not issued for this audience")
+	}
+	if v.config.RolesClaim != "" {
+		var raw map[string]interface{}
+		if err := decodeSegment(parts[1], &raw); err != nil {
+			return nil, fmt.Errorf("malformed token claims: %v", err)
+		}
+		claims.Roles = claimStrings(raw, v.config.RolesClaim)
+	}
+	return &claims, nil
+}
+
+// claimStrings returns the strings of a claim, given by its dot separated
+// path. A string claim is split at spaces, as scope claims are.
+func claimStrings(claims map[string]interface{}, path string) []string {
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		nested, ok := claims[name].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		claims = nested
+	}
+	switch value := claims[names[len(names)-1]].(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		values := []string{}
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+func (a audience) contains(value string) bool {
+	for _, item := range a {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// verifySignature checks a signature with the key of the algorithm's kind,
+// so a token cannot pick, say, HMAC with a public key as secret.
+func (v *jwtVerifier) verifySignature(ctx context.Context, alg string, kid string, input string, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+
+	if strings.HasPrefix(alg, "HS") {
+		if len(v.secret) == 0 {
+			return fmt.Errorf("unsupported token algorithm %q", alg)
+		}
+		mac := hmac.New(hash.New, v.secret)
+		mac.Write([]byte(input))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	}
+
+	key := v.key
+	if key == nil && v.jwks != nil {
+		var err error
+		if key, err = v.jwks.key(ctx, kid); err != nil {
+			return err
+		}
+	}
+	if key == nil {
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	digest := hash.New()
+	digest.Write([]byte(input))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("token algorithm %q does not match the key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(key, hash, digest.Sum(nil), signature); err != nil {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || ecdsaHash(key.Curve) != hash {
+			return fmt.Errorf("token algorithm %q does not match the key", alg)
+		}
+		if len(signature) != 2*size {
+			return errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest.Sum(nil), r, s) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// ecdsaHash returns the hash ES256, ES384 and ES512 use with a curve.
+func ecdsaHash(curve elliptic.Curve) crypto.Hash {
+	switch curve {
+	case elliptic.P256():
+		return crypto.SHA256
+	case elliptic.P384():
+		return crypto.SHA384
+	case elliptic.P521():
+		return crypto.SHA512
+	default:
+		return 0
+	}
+}
+
+// jwksMinRefetch bounds how often unknown key ids, or failures, make the keys
+// be fetched again.
+const jwksMinRefetch = time.Minute
+
+// jwksCache holds the keys published at a JWKS URL, by key id. Keys are
+// fetched by one request at a time, without holding the lock, and stale keys
+// are served while they are fetched again.
+type jwksCache struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	// attempted is when the last fetch started. fetching is closed when the
+	// fetch in flight, if any, completes, with fetchErr.
+	attempted time.Time
+	fetching  chan struct{}
+	fetchErr  error
+}
+
+func newJWKSCache(url string, refresh time.Duration) *jwksCache {
+	return &jwksCache{
+		url:     url,
+		refresh: refresh,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		keys:    map[string]crypto.PublicKey{},
+	}
+}
+
+// key returns the key of a key id. Keys are fetched again in the background
+// when refresh has passed, and waited for when the key id is unknown, as
+// after the issuer rotated its keys. Keys known already stay in use while
+// the JWKS URL fails.
+func (c *jwksCache) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	retry := time.Since(c.attempted) > jwksMinRefetch
+	if ok {
+		if time.Since(c.fetched) > c.refresh && retry {
+			c.startFetch()
+		}
+		c.mu.Unlock()
+		return key, nil
+	}
+	done := c.fetching
+	if done == nil && retry {
+		done = c.startFetch()
+	}
+	c.mu.Unlock()
+	if done == nil {
+		return nil, fmt.Errorf("unknown token key id %q", kid)
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	if c.fetchErr != nil {
+		return nil, c.fetchErr
+	}
+	return nil, fmt.Errorf("unknown token key id %q", kid)
+}
+
+// startFetch fetches the keys in the background, unless a fetch is in
+// flight already, and returns the channel closed when it completes. c.mu is
+// held by the caller.
+func (c *jwksCache) startFetch() chan struct{} {
+	if c.fetching != nil {
+		return c.fetching
+	}
+	done := make(chan struct{})
+	c.fetching, c.attempted = done, time.Now()
+	go func() {
+		// Callers stop waiting when their requests end, the fetch does not.
+		keys, err := c.fetch(context.Background())
+		c.mu.Lock()
+		if err == nil {
+			c.keys, c.fetched = keys, time.Now()
+		}
+		c.fetching, c.fetchErr = nil, err
+		c.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+func (c *jwksCache) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", c.url, response.Status)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("fetching %s: %v", c.url, err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// Keys of other types are skipped, so new kinds of keys do not
+		// break the ones in use.
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC keys
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
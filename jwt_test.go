@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	testRSAKey   = mustRSAKey()
+	testRSAKey2  = mustRSAKey()
+	testECKey    = mustECKey()
+	testJWTHours = time.Now().Add(time.Hour).Unix()
+)
+
+func mustRSAKey() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func mustECKey() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func publicKeyPEM(t *testing.T, key crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// signJWT returns a token of claims signed by key with alg: a secret as
+// []byte, an RSA or EC private key, or nil for no signature.
+func signJWT(t *testing.T, alg string, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	encode := func(value interface{}) string {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	input := encode(header) + "." + encode(claims)
+
+	hash := crypto.SHA256
+	switch {
+	case strings.HasSuffix(alg, "384"):
+		hash = crypto.SHA384
+	case strings.HasSuffix(alg, "512"):
+		hash = crypto.SHA512
+	}
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, key)
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := hash.New()
+		digest.Write([]byte(input))
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest.Sum(nil)); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		digest := hash.New()
+		digest.Write([]byte(input))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// claims returns valid claims for user "u1", changed by the given pairs.
+func claims(pairs ...interface{}) map[string]interface{} {
+	c := map[string]interface{}{"sub": "u1", "exp": testJWTHours}
+	for i := 0; i < len(pairs); i += 2 {
+		if pairs[i+1] == nil {
+			delete(c, pairs[i].(string))
+		} else {
+			c[pairs[i].(string)] = pairs[i+1]
+		}
+	}
+	return c
+}
+
+func TestJWTVerify(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	rsaPEM := publicKeyPEM(t, &testRSAKey.PublicKey)
+	ecPEM := publicKeyPEM(t, &testECKey.PublicKey)
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name   string
+		config JWTConfig
+		token  string
+		valid  bool
+	}{
+		{"HS256", JWTConfig{Secret: string(secret)}, signJWT(t, "HS256", "", secret, claims()), true},
+		{"HS512", JWTConfig{Secret: string(secret)}, signJWT(t, "HS512", "", secret, claims()), true},
+		{"HS256 with another secret", JWTConfig{Secret: string(secret)}, signJWT(t, "HS256", "", []byte("other"), claims()), false},
+		{"RS256", JWTConfig{PublicKey: rsaPEM}, signJWT(t, "RS256", "", testRSAKey, claims()), true},
+		{"RS256 by another key", JWTConfig{PublicKey: rsaPEM}, signJWT(t, "RS256", "", testRSAKey2, claims()), false},
+		{"ES256", JWTConfig{PublicKey: ecPEM}, signJWT(t, "ES256", "", testECKey, claims()), true},
+		{"ES384 with a P-256 key", JWTConfig{PublicKey: ecPEM}, signJWT(t, "ES384", "", testECKey, claims()), false},
+		{"RS256 with an EC key", JWTConfig{PublicKey: ecPEM}, signJWT(t, "RS256", "", testRSAKey, claims()), false},
+
+		// The public key is no secret, so an HMAC made with it proves
+		// nothing.
+		{"HS256 with the public key as secret", JWTConfig{PublicKey: rsaPEM}, signJWT(t, "HS256", "", []byte(rsaPEM), claims()), false},
+		{"HS256 with the public key as secret, secret configured", JWTConfig{Secret: string(secret), PublicKey: rsaPEM},
+			signJWT(t, "HS256", "", []byte(rsaPEM), claims()), false},
+		{"none", JWTConfig{Secret: string(secret)}, signJWT(t, "none", "", nil, claims()), false},
+		{"none with a public key", JWTConfig{PublicKey: rsaPEM}, signJWT(t, "none", "", nil, claims()), false},
+		{"empty alg", JWTConfig{Secret: string(secret)}, signJWT(t, "x", "", nil, claims()), false},
+		{"unknown alg", JWTConfig{Secret: string(secret)}, signJWT(t, "PS256", "", nil, claims()), false},
+		{"malformed", JWTConfig{Secret: string(secret)}, "a.b", false},
+
+		{"expired within the skew", JWTConfig{Secret: string(secret)}, signJWT(t, "HS256", "", secret, claims("exp", now.Add(-30*time.Second).Unix())), true},
+		{"expired beyond the skew", JWTConfig{Secret: string(secret)}, signJWT(t, "HS256", "", secret, claims("exp", now.Add(-2*time.Minute).Unix())), false},
+		{"not expiring", JWTConfig{Secret: string(secret)}, signJWT(t, "HS256", "", secret, claims("exp", nil)), false},
+		{"not before within the skew", JWTConfig{Secret: string(secret)}, signJWT(t, "HS256", "", secret, claims("nbf", now.Add(30*time.Second).Unix())), true},
+		{"not before beyond the skew", JWTConfig{Secret: string(secret)}, signJWT(t, "HS256", "", secret, claims("nbf", now.Add(2*time.Minute).Unix())), false},
+		{"no subject", JWTConfig{Secret: string(secret)}, signJWT(t, "HS256", "", secret, claims("sub", nil)), false},
+
+		{"issuer", JWTConfig{Secret: string(secret), Issuer: "https://id.test"}, signJWT(t, "HS256", "", secret, claims("iss", "https://id.test")), true},
+		{"other issuer", JWTConfig{Secret: string(secret), Issuer: "https://id.test"}, signJWT(t, "HS256", "", secret, claims("iss", "https://evil.test")), false},
+		{"no issuer", JWTConfig{Secret: string(secret), Issuer: "https://id.test"}, signJWT(t, "HS256", "", secret, claims()), false},
+		{"audience", JWTConfig{Secret: string(secret), Audience: "ad-manager"}, signJWT(t, "HS256", "", secret, claims("aud", "ad-manager")), true},
+		{"audience in list", JWTConfig{Secret: string(secret), Audience: "ad-manager"}, signJWT(t, "HS256", "", secret, claims("aud", []string{"other", "ad-manager"})), true},
+		{"other audience", JWTConfig{Secret: string(secret), Audience: "ad-manager"}, signJWT(t, "HS256", "", secret, claims("aud", "other")), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			verifier, err := newJWTVerifier(tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := verifier.Verify(context.Background(), tc.token)
+			if tc.valid && (err != nil || claims.Subject != "u1") {
+				t.Errorf("got %+v, %v, want the token accepted", claims, err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("got %+v, want the token rejected", claims)
+			}
+		})
+	}
+}
+
+func TestJWTRoles(t *testing.T) {
+	secret := []byte("secret")
+	verifier, err := newJWTVerifier(JWTConfig{Secret: string(secret), RolesClaim: "realm_access.roles"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signJWT(t, "HS256", "", secret, claims("realm_access", map[string]interface{}{"roles": []string{"moderator", "user"}}))
+	claims, err := verifier.Verify(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"moderator", "user"}; !reflect.DeepEqual(claims.Roles, want) {
+		t.Errorf("got %v, want %v", claims.Roles, want)
+	}
+}
+
+// jwksServer publishes the RSA keys it is given, by key id, and counts the
+// requests for them. Requests block while hold is locked.
+type jwksServer struct {
+	mu       sync.Mutex
+	keys     map[string]*rsa.PublicKey
+	hold     sync.RWMutex
+	requests int32
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&s.requests, 1)
+	s.hold.RLock()
+	defer s.hold.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	for kid, key := range s.keys {
+		set.Keys = append(set.Keys, jsonWebKey{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	json.NewEncoder(w).Encode(set)
+}
+
+func (s *jwksServer) publish(keys map[string]*rsa.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func TestJWKSKeyRotation(t *testing.T) {
+	jwks := &jwksServer{keys: map[string]*rsa.PublicKey{"k1": &testRSAKey.PublicKey}}
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+	verifier, err := newJWTVerifier(JWTConfig{JWKSURL: server.URL, JWKSRefresh: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	oldToken := signJWT(t, "RS256", "k1", testRSAKey, claims())
+	newToken := signJWT(t, "RS256", "k2", testRSAKey2, claims())
+
+	if _, err := verifier.Verify(ctx, oldToken); err != nil {
+		t.Fatalf("k1: %v", err)
+	}
+	// A token claiming k1 but signed by another key is no k1 token.
+	if _, err := verifier.Verify(ctx, signJWT(t, "RS256", "k1", testRSAKey2, claims())); err == nil {
+		t.Errorf("k1 forged: got no error")
+	}
+
+	// The issuer rotates to k2. Unknown key ids are fetched at most once a
+	// jwksMinRefetch.
+	jwks.publish(map[string]*rsa.PublicKey{"k2": &testRSAKey2.PublicKey})
+	if _, err := verifier.Verify(ctx, newToken); err == nil {
+		t.Errorf("k2 right after a fetch: got no error")
+	}
+	verifier.jwks.mu.Lock()
+	verifier.jwks.attempted = time.Now().Add(-2 * jwksMinRefetch)
+	verifier.jwks.mu.Unlock()
+	if _, err := verifier.Verify(ctx, newToken); err != nil {
+		t.Errorf("k2: %v", err)
+	}
+	if _, err := verifier.Verify(ctx, oldToken); err == nil {
+		t.Errorf("k1 after rotation: got no error")
+	}
+	if got := atomic.LoadInt32(&jwks.requests); got != 2 {
+		t.Errorf("got %d fetches, want 2", got)
+	}
+}
+
+func TestJWKSFetchOutsideLock(t *testing.T) {
+	jwks := &jwksServer{keys: map[string]*rsa.PublicKey{"k1": &testRSAKey.PublicKey}}
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+	cache := newJWKSCache(server.URL, time.Hour)
+	ctx := context.Background()
+
+	// Callers asking for an unknown key together share one fetch.
+	jwks.hold.Lock()
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.key(ctx, "k1")
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	jwks.hold.Unlock()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("k1: %v", err)
+		}
+	}
+	if got := atomic.LoadInt32(&jwks.requests); got != 1 {
+		t.Errorf("got %d fetches, want 1", got)
+	}
+
+	// Once stale, known keys are served while the keys are fetched again,
+	// however long that takes.
+	jwks.hold.Lock()
+	cache.mu.Lock()
+	cache.fetched = time.Now().Add(-2 * time.Hour)
+	cache.attempted = cache.fetched
+	cache.mu.Unlock()
+	waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if _, err := cache.key(waitCtx, "k1"); err != nil {
+		t.Errorf("stale k1: %v", err)
+	}
+	// Callers of unknown keys give up with their request, not the lock.
+	waitCtx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := cache.key(waitCtx, "k2"); err != context.DeadlineExceeded {
+		t.Errorf("k2 while fetching: got %v, want context.DeadlineExceeded", err)
+	}
+	if _, err := cache.key(ctx, "k1"); err != nil {
+		t.Errorf("k1 while fetching: %v", err)
+	}
+	jwks.hold.Unlock()
+}
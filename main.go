@@ -1,24 +1,53 @@
 package main
 
 import (
-	"cloud.google.com/go/storage"
 	"context"
 	"fmt"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/spf13/viper"
-	"google.golang.org/api/option"
 	"google.golang.org/grpc"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
 	viper.AutomaticEnv()
+	viper.SetDefault("STORAGE_BACKEND", "gcs")
+	viper.SetDefault("STORAGE_BUCKET", "meshetr-images")
+	viper.SetDefault("BLOB_PURGE_INTERVAL", time.Minute)
+	viper.SetDefault("GC_GRACE_PERIOD", time.Hour)
+	viper.SetDefault("GC_DRY_RUN", true)
+	viper.SetDefault("PROCESSING_WORKERS", 4)
+	viper.SetDefault("PROCESSING_MAX_ATTEMPTS", 8)
+	viper.SetDefault("PROCESSOR_TIMEOUT", 10*time.Second)
+	viper.SetDefault("PROCESSOR_STREAM_TIMEOUT", 45*time.Second)
+	viper.SetDefault("PROCESSOR_RETRIES", 2)
+	viper.SetDefault("UPLOAD_MAX_BYTES", 20<<20)
+	viper.SetDefault("UPLOAD_MAX_WIDTH", 12000)
+	viper.SetDefault("UPLOAD_MAX_HEIGHT", 12000)
+	viper.SetDefault("UPLOAD_MAX_PIXELS", 50000000)
+	viper.SetDefault("UPLOAD_MAX_BATCH", 20)
+	viper.SetDefault("UPLOAD_WORKERS", 4)
+	viper.SetDefault("UPLOAD_URL_EXPIRY", 15*time.Minute)
+	viper.SetDefault("UPLOAD_EXPIRY", 24*time.Hour)
+	viper.SetDefault("UPLOAD_BASE_URL", "http://localhost:8080/manager/api/v1")
+	viper.SetDefault("METADATA_ALLOW", "icc")
+	viper.SetDefault("QUOTA_MAX_PHOTOS_PER_AD", 20)
+	viper.SetDefault("QUOTA_MAX_ADS_PER_USER", 50)
+	viper.SetDefault("QUOTA_MAX_BYTES_PER_USER", 1<<30)
+	viper.SetDefault("QUOTA_MAX_PHOTOS_PER_HOUR", 0)
+	viper.SetDefault("AUTH_JWKS_REFRESH", time.Hour)
+	viper.SetDefault("AUTH_ROLES_CLAIM", "roles")
+	viper.SetDefault("AUTH_DEFAULT_ROLES", "user")
+	viper.SetDefault("API_KEY_ROTATION_GRACE", 24*time.Hour)
 	var (
 		httpAddr = ":8080"
 		dsn      = "host=" + viper.GetString("DB_HOST") +
@@ -40,15 +69,40 @@ func main() {
 	}
 
 	ctx := context.Background()
-	storageClient, err := storage.NewClient(ctx, option.WithCredentialsJSON([]byte(viper.GetString("GCP_CLIENT_SECRET"))))
+	blobStore, err := NewBlobStore(ctx, BlobStoreConfig{
+		Backend:            viper.GetString("STORAGE_BACKEND"),
+		Bucket:             viper.GetString("STORAGE_BUCKET"),
+		GCPCredentialsJSON: viper.GetString("GCP_CLIENT_SECRET"),
+		S3: S3Config{
+			Endpoint:        viper.GetString("S3_ENDPOINT"),
+			Region:          viper.GetString("S3_REGION"),
+			PathStyle:       viper.GetBool("S3_PATH_STYLE"),
+			AccessKeyID:     viper.GetString("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: viper.GetString("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    viper.GetString("AWS_SESSION_TOKEN"),
+		},
+		LocalDir:  viper.GetString("STORAGE_LOCAL_DIR"),
+		PublicURL: viper.GetString("STORAGE_PUBLIC_URL"),
+	})
 	if err != nil {
-		level.Error(logger).Log("component", "storage.NewClient", "msg", err)
-	} else {
-		defer storageClient.Close()
+		level.Error(logger).Log("component", "NewBlobStore", "msg", err)
+		os.Exit(1)
+	}
+	if closer, ok := blobStore.(io.Closer); ok {
+		defer closer.Close()
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		if err := runGarbageCollection(ctx, logger, db, blobStore, os.Args[2:], os.Stdout); err != nil {
+			level.Error(logger).Log("component", "gc", "msg", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// The connection is established in the background and re-established
+	// whenever it drops, so startup does not wait for the image processor.
 	opts = append(opts, grpc.WithInsecure())
-	opts = append(opts, grpc.WithBlock())
 	conn, err := grpc.Dial(viper.GetString("IMAGE_PROCESSOR_URL"), opts...)
 	if err != nil {
 		level.Error(logger).Log("component", "grpc.DIal", "msg", err)
@@ -56,19 +110,96 @@ func main() {
 		defer conn.Close()
 	}
 
+	uploadLimits := UploadLimits{
+		MaxBytes:  viper.GetInt64("UPLOAD_MAX_BYTES"),
+		MaxWidth:  viper.GetInt("UPLOAD_MAX_WIDTH"),
+		MaxHeight: viper.GetInt("UPLOAD_MAX_HEIGHT"),
+		MaxPixels: viper.GetInt64("UPLOAD_MAX_PIXELS"),
+		MaxBatch:  viper.GetInt("UPLOAD_MAX_BATCH"),
+	}
+
+	quotas := Quotas{
+		MaxPhotosPerAd:   viper.GetInt("QUOTA_MAX_PHOTOS_PER_AD"),
+		MaxAdsPerUser:    viper.GetInt("QUOTA_MAX_ADS_PER_USER"),
+		MaxBytesPerUser:  viper.GetInt64("QUOTA_MAX_BYTES_PER_USER"),
+		MaxPhotosPerHour: viper.GetInt("QUOTA_MAX_PHOTOS_PER_HOUR"),
+	}
+
+	// Without a key authentication is disabled. A key that fails to load
+	// leaves the verifier nil while auth stays required, so changes are
+	// refused rather than let through.
+	jwtConfig := JWTConfig{
+		Secret:      viper.GetString("AUTH_JWT_SECRET"),
+		PublicKey:   viper.GetString("AUTH_JWT_PUBLIC_KEY"),
+		JWKSURL:     viper.GetString("AUTH_JWKS_URL"),
+		JWKSRefresh: viper.GetDuration("AUTH_JWKS_REFRESH"),
+		Issuer:      viper.GetString("AUTH_ISSUER"),
+		Audience:    viper.GetString("AUTH_AUDIENCE"),
+		RolesClaim:  viper.GetString("AUTH_ROLES_CLAIM"),
+	}
+	var verifier *jwtVerifier
+	if jwtConfig.Enabled() {
+		if verifier, err = newJWTVerifier(jwtConfig); err != nil {
+			level.Error(logger).Log("component", "newJWTVerifier", "msg", err)
+		}
+	} else {
+		level.Info(logger).Log("component", "auth", "msg", "no AUTH_JWT_SECRET, AUTH_JWT_PUBLIC_KEY or AUTH_JWKS_URL set, authentication is disabled")
+	}
+
+	// An invalid policy grants nothing, rather than falling back to the
+	// default.
+	policy := DefaultPolicy
+	if data := viper.GetString("AUTH_POLICY"); data != "" {
+		if policy, err = ParsePolicy(data); err != nil {
+			level.Error(logger).Log("component", "ParsePolicy", "msg", err)
+			policy = Policy{}
+		}
+	}
+	authorizer := NewAuthorizer(logger, db, policy, strings.Split(viper.GetString("AUTH_DEFAULT_ROLES"), ","), jwtConfig.Enabled())
+
+	metadataAllowList, err := ParseMetadataAllowList(strings.Split(viper.GetString("METADATA_ALLOW"), ","))
+	if err != nil {
+		level.Error(logger).Log("component", "ParseMetadataAllowList", "msg", err)
+	}
+
 	var service Service
 	{
-		service = MakeService(logger, db, storageClient, conn)
+		service = MakeService(logger, db, blobStore, conn, ServiceConfig{
+			ProcessingWorkers:      viper.GetInt("PROCESSING_WORKERS"),
+			ProcessingMaxAttempts:  viper.GetInt("PROCESSING_MAX_ATTEMPTS"),
+			StorageBackend:         viper.GetString("STORAGE_BACKEND"),
+			StorageBucket:          viper.GetString("STORAGE_BUCKET"),
+			ProcessorTimeout:       viper.GetDuration("PROCESSOR_TIMEOUT"),
+			ProcessorStreamTimeout: viper.GetDuration("PROCESSOR_STREAM_TIMEOUT"),
+			ProcessorRetries:       viper.GetInt("PROCESSOR_RETRIES"),
+			UploadLimits:           uploadLimits,
+			UploadWorkers:          viper.GetInt("UPLOAD_WORKERS"),
+			Quotas:                 quotas,
+			RequireAuth:            jwtConfig.Enabled(),
+			APIKeyRotationGrace:    viper.GetDuration("API_KEY_ROTATION_GRACE"),
+			UploadURLExpiry:        viper.GetDuration("UPLOAD_URL_EXPIRY"),
+			UploadExpiry:           viper.GetDuration("UPLOAD_EXPIRY"),
+			UploadSigningKey:       viper.GetString("UPLOAD_SIGNING_KEY"),
+			UploadBaseURL:          viper.GetString("UPLOAD_BASE_URL"),
+			MetadataAllowList:      metadataAllowList,
+			ContentAddressed:       viper.GetBool("CONTENT_ADDRESSED_STORAGE"),
+		})
+	}
+
+	go NewBlobPurger(logger, db, blobStore).Run(ctx, viper.GetDuration("BLOB_PURGE_INTERVAL"))
+	if interval := viper.GetDuration("GC_INTERVAL"); interval > 0 {
+		gc := NewGarbageCollector(logger, db, blobStore, viper.GetDuration("GC_GRACE_PERIOD"))
+		go gc.Run(ctx, interval, viper.GetBool("GC_DRY_RUN"))
 	}
 
 	var httpHandler http.Handler
 	{
-		httpHandler = MakeHTTPHandler(logger, service)
+		httpHandler = MakeHTTPHandler(logger, service, uploadLimits, verifier, authorizer)
 	}
 
 	errs := make(chan error)
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 		errs <- fmt.Errorf("%s", <-c)
 	}()
@@ -0,0 +1,650 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strings"
+)
+
+// MetadataAllowList tells which metadata stripMetadata keeps. GPS data is
+// never kept.
+type MetadataAllowList struct {
+	// ICC keeps embedded color profiles, which images need to display
+	// their colors right.
+	ICC bool
+	// XMP keeps XMP packets. They may contain a location too.
+	XMP bool
+	// IPTC keeps IPTC records, e.g. captions and credits.
+	IPTC bool
+	// Comment keeps JPEG comments and PNG text chunks.
+	Comment bool
+
+	exifTags       map[uint16]bool
+	exifSubIFDTags map[uint16]bool
+}
+
+// ParseMetadataAllowList parses a list of metadata names: "icc", "xmp",
+// "iptc", "comment" or the name of an EXIF tag, e.g. "Copyright". Unknown
+// names are reported in the error and otherwise ignored.
+func ParseMetadataAllowList(names []string) (MetadataAllowList, error) {
+	allow := MetadataAllowList{exifTags: map[uint16]bool{}, exifSubIFDTags: map[uint16]bool{}}
+	unknown := []string{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		switch strings.ToLower(name) {
+		case "":
+		case "icc":
+			allow.ICC = true
+		case "xmp":
+			allow.XMP = true
+		case "iptc":
+			allow.IPTC = true
+		case "comment":
+			allow.Comment = true
+		default:
+			if tag, ok := exifIFD0Tags[name]; ok {
+				allow.exifTags[tag] = true
+			} else if tag, ok := exifSubIFDTags[name]; ok {
+				allow.exifSubIFDTags[tag] = true
+			} else {
+				unknown = append(unknown, name)
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		return allow, fmt.Errorf("unknown metadata %s", strings.Join(unknown, ", "))
+	}
+	return allow, nil
+}
+
+// stripMetadata removes the metadata of an image that allow does not list.
+// The EXIF orientation is applied by rotating the pixels of JPEG and PNG
+// images, which are re-encoded for it. WebP images cannot be re-encoded, so
+// they keep the orientation tag instead. HEIC images are oriented by their
+// container, and their metadata is blanked in place since it is referenced
+// by file offsets. Images with more than maxPixels pixels are not decoded
+// for orienting, unless maxPixels is 0. info is updated to match the result.
+func stripMetadata(data []byte, info *imageInfo, allow MetadataAllowList, maxPixels int64) ([]byte, error) {
+	var out []byte
+	var err error
+	switch info.Format {
+	case "jpeg":
+		out, err = stripJPEG(data, allow, maxPixels)
+	case "png":
+		out, err = stripPNG(data, allow, maxPixels)
+	case "webp":
+		out, err = stripWebP(data, allow)
+	case "heic":
+		out, err = stripHEIC(data, allow)
+	default:
+		return nil, ErrUnsupportedMediaType
+	}
+	if err != nil {
+		return nil, err
+	}
+	config, err := decodeConfig(out, info.Format)
+	if err != nil {
+		return nil, err
+	}
+	info.Width, info.Height, info.Size = config.Width, config.Height, int64(len(out))
+	return out, nil
+}
+
+// checkPixels fails with ErrImageDimensions if the image has more than
+// maxPixels pixels, before it is decoded.
+func checkPixels(data []byte, format string, maxPixels int64) error {
+	config, err := decodeConfig(data, format)
+	if err != nil {
+		return ErrInvalidImage
+	}
+	if maxPixels > 0 && int64(config.Width)*int64(config.Height) > maxPixels {
+		return ErrImageDimensions
+	}
+	return nil
+}
+
+func decodeConfig(data []byte, format string) (image.Config, error) {
+	switch format {
+	case "jpeg":
+		return jpeg.DecodeConfig(bytes.NewReader(data))
+	case "png":
+		return png.DecodeConfig(bytes.NewReader(data))
+	case "webp":
+		return webpConfig(data)
+	default:
+		return heicConfig(data)
+	}
+}
+
+// stripJPEG keeps the segments needed to decode the image, APP0 (JFIF) and
+// APP14 (Adobe) included, and the allowed metadata segments. APP14 describes
+// the original's color transform, so it is dropped when re-encoding.
+func stripJPEG(data []byte, allow MetadataAllowList, maxPixels int64) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, ErrInvalidImage
+	}
+	var header, metadata [][]byte
+	orientation := 1
+	var exif *exifData
+	pos := 2
+	for {
+		if pos+4 > len(data) || data[pos] != 0xff {
+			return nil, ErrInvalidImage
+		}
+		marker := data[pos+1]
+		if marker == 0xff {
+			// Fill byte.
+			pos++
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, ErrInvalidImage
+		}
+		segment, body := data[pos:pos+2+length], data[pos+4:pos+2+length]
+		if marker == 0xda {
+			// Start of scan; the rest is image data.
+			header = append(header, data[pos:])
+			break
+		}
+		pos += 2 + length
+
+		switch {
+		case marker == 0xe0:
+			metadata = append(metadata, segment)
+		case marker == 0xee:
+			header = append(header, segment)
+		case marker == 0xe1 && bytes.HasPrefix(body, []byte("Exif\x00\x00")):
+			if parsed, err := parseExif(body[6:]); err == nil {
+				exif, orientation = parsed, parsed.Orientation()
+			}
+			// Placeholder, replaced by the filtered EXIF below.
+			metadata = append(metadata, nil)
+		case marker == 0xe1 && bytes.HasPrefix(body, []byte("http://ns.adobe.com/xap/1.0/\x00")):
+			if allow.XMP {
+				metadata = append(metadata, segment)
+			}
+		case marker == 0xe2 && bytes.HasPrefix(body, []byte("ICC_PROFILE\x00")):
+			if allow.ICC {
+				metadata = append(metadata, segment)
+			}
+		case marker == 0xed:
+			if allow.IPTC {
+				metadata = append(metadata, segment)
+			}
+		case marker == 0xfe:
+			if allow.Comment {
+				metadata = append(metadata, segment)
+			}
+		case marker >= 0xe0 && marker <= 0xef:
+			// Other application data, e.g. MPF, whose offsets would break.
+		default:
+			header = append(header, segment)
+		}
+	}
+
+	var exifSegment []byte
+	if exif != nil {
+		if tiff, empty := exif.Filter(allow, false); !empty {
+			exifSegment = jpegSegment(0xe1, append([]byte("Exif\x00\x00"), tiff...))
+		}
+	}
+	out := &bytes.Buffer{}
+	out.Write([]byte{0xff, 0xd8})
+	for _, segment := range metadata {
+		if segment == nil {
+			segment = exifSegment
+		}
+		out.Write(segment)
+	}
+	if orientation == 1 {
+		for _, segment := range header {
+			out.Write(segment)
+		}
+		return out.Bytes(), nil
+	}
+
+	if err := checkPixels(data, "jpeg", maxPixels); err != nil {
+		return nil, err
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	encoded := &bytes.Buffer{}
+	if err := jpeg.Encode(encoded, orient(img, orientation), &jpeg.Options{Quality: 92}); err != nil {
+		return nil, err
+	}
+	// Skip the encoder's SOI.
+	out.Write(encoded.Bytes()[2:])
+	return out.Bytes(), nil
+}
+
+func jpegSegment(marker byte, body []byte) []byte {
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(body)+2))
+	return append(segment, body...)
+}
+
+// pngColorChunks are the ancillary PNG chunks that affect how colors are
+// displayed. They are carried over when an image is re-encoded.
+var pngColorChunks = map[string]bool{"gAMA": true, "cHRM": true, "sRGB": true}
+
+// stripPNG keeps critical chunks, the ancillary chunks describing pixels
+// and the allowed metadata chunks.
+func stripPNG(data []byte, allow MetadataAllowList, maxPixels int64) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, ErrInvalidImage
+	}
+	var chunks [][]byte
+	// carried are the chunks kept when the image is re-encoded.
+	var carried [][]byte
+	orientation := 1
+	for pos := len(signature); pos < len(data); {
+		if pos+12 > len(data) {
+			return nil, ErrInvalidImage
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if length < 0 || pos+12+length > len(data) {
+			return nil, ErrInvalidImage
+		}
+		chunk := data[pos : pos+12+length]
+		kind, body := string(chunk[4:8]), chunk[8:8+length]
+		pos += 12 + length
+
+		switch kind {
+		case "eXIf":
+			if exif, err := parseExif(body); err == nil {
+				orientation = exif.Orientation()
+				if tiff, empty := exif.Filter(allow, false); !empty {
+					chunk = pngChunk("eXIf", tiff)
+					chunks = append(chunks, chunk)
+					carried = append(carried, chunk)
+				}
+			}
+		case "iCCP":
+			if allow.ICC {
+				chunks = append(chunks, chunk)
+				carried = append(carried, chunk)
+			}
+		case "tEXt", "zTXt", "iTXt":
+			keep := allow.Comment
+			if bytes.HasPrefix(body, []byte("XML:com.adobe.xmp\x00")) {
+				keep = allow.XMP
+			}
+			if keep {
+				chunks = append(chunks, chunk)
+				carried = append(carried, chunk)
+			}
+		case "tIME":
+		default:
+			// Critical chunks start with an upper case letter.
+			if kind[0] >= 'A' && kind[0] <= 'Z' || kind == "tRNS" || kind == "bKGD" || kind == "pHYs" ||
+				kind == "sBIT" || kind == "hIST" || kind == "sPLT" || pngColorChunks[kind] {
+				chunks = append(chunks, chunk)
+			}
+			if pngColorChunks[kind] {
+				carried = append(carried, chunk)
+			}
+		}
+	}
+
+	out := &bytes.Buffer{}
+	if orientation == 1 {
+		out.WriteString(signature)
+		for _, chunk := range chunks {
+			out.Write(chunk)
+		}
+		return out.Bytes(), nil
+	}
+
+	if err := checkPixels(data, "png", maxPixels); err != nil {
+		return nil, err
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	encoded := &bytes.Buffer{}
+	if err := png.Encode(encoded, orient(img, orientation)); err != nil {
+		return nil, err
+	}
+	// The carried chunks go right after IHDR, before any image data.
+	ihdrEnd := len(signature) + 12 + int(binary.BigEndian.Uint32(encoded.Bytes()[len(signature):]))
+	out.Write(encoded.Bytes()[:ihdrEnd])
+	for _, chunk := range carried {
+		out.Write(chunk)
+	}
+	out.Write(encoded.Bytes()[ihdrEnd:])
+	return out.Bytes(), nil
+}
+
+func pngChunk(kind string, body []byte) []byte {
+	chunk := make([]byte, 8, 12+len(body))
+	binary.BigEndian.PutUint32(chunk, uint32(len(body)))
+	copy(chunk[4:], kind)
+	chunk = append(chunk, body...)
+	// The CRC covers type and body.
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc...)
+}
+
+// stripWebP drops the EXIF, XMP and ICCP chunks of extended WebP files as
+// allowed, and updates the VP8X flags and the RIFF size to match.
+func stripWebP(data []byte, allow MetadataAllowList) ([]byte, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, ErrInvalidImage
+	}
+	if len(data) < 16 || string(data[12:16]) != "VP8X" {
+		// Simple files hold no metadata.
+		return data, nil
+	}
+	const (
+		flagICC  = 0x20
+		flagEXIF = 0x08
+		flagXMP  = 0x04
+	)
+	out := &bytes.Buffer{}
+	out.Write(data[0:12])
+	var vp8x []byte
+	flags := byte(0)
+	for pos := 12; pos < len(data); {
+		if pos+8 > len(data) {
+			return nil, ErrInvalidImage
+		}
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size + size%2
+		if size < 0 || pos+8+size > len(data) {
+			return nil, ErrInvalidImage
+		}
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk, body := data[pos:end], data[pos+8:pos+8+size]
+		pos = end
+
+		switch string(chunk[0:4]) {
+		case "VP8X":
+			if len(body) < 10 {
+				return nil, ErrInvalidImage
+			}
+			vp8x = make([]byte, len(chunk))
+			copy(vp8x, chunk)
+			flags = vp8x[8] &^ (flagICC | flagEXIF | flagXMP)
+			// Written once the flags are known.
+			out.Write(vp8x)
+			continue
+		case "EXIF":
+			exif, err := parseExif(bytes.TrimPrefix(body, []byte("Exif\x00\x00")))
+			if err != nil {
+				continue
+			}
+			tiff, empty := exif.Filter(allow, true)
+			if empty {
+				continue
+			}
+			chunk = riffChunk("EXIF", tiff)
+			flags |= flagEXIF
+		case "XMP ":
+			if !allow.XMP {
+				continue
+			}
+			flags |= flagXMP
+		case "ICCP":
+			if !allow.ICC {
+				continue
+			}
+			flags |= flagICC
+		}
+		out.Write(chunk)
+	}
+	result := out.Bytes()
+	if vp8x != nil {
+		result[12+8] = flags
+	}
+	binary.LittleEndian.PutUint32(result[4:8], uint32(len(result)-8))
+	return result, nil
+}
+
+func riffChunk(kind string, body []byte) []byte {
+	chunk := make([]byte, 8, 8+len(body)+1)
+	copy(chunk, kind)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(body)))
+	chunk = append(chunk, body...)
+	if len(body)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// stripHEIC overwrites the Exif item of a HEIF file with its filtered EXIF
+// and, unless allowed, XMP items with spaces. Items are located through the
+// iinf and iloc boxes; their sizes stay the same so no offset changes.
+func stripHEIC(data []byte, allow MetadataAllowList) ([]byte, error) {
+	out := make([]byte, len(data))
+	copy(out, data)
+	meta := isoBox(out, "meta")
+	if len(meta) < 4 {
+		return nil, ErrInvalidImage
+	}
+	items := heicItemTypes(isoBox(meta[4:], "iinf"))
+	locations, err := heicItemLocations(isoBox(meta[4:], "iloc"), len(out))
+	if err != nil {
+		return nil, err
+	}
+	for id, kind := range items {
+		extents, ok := locations[id]
+		if !ok {
+			continue
+		}
+		var payload []byte
+		for _, extent := range extents {
+			payload = append(payload, out[extent[0]:extent[0]+extent[1]]...)
+		}
+		switch kind {
+		case "Exif":
+			// A 4 byte offset to the TIFF header precedes it.
+			replacement := make([]byte, len(payload))
+			if len(payload) >= 4 {
+				start := 4 + int(binary.BigEndian.Uint32(payload))
+				if start <= len(payload) {
+					if exif, err := parseExif(payload[start:]); err == nil {
+						tiff, _ := exif.Filter(allow, false)
+						if 4+len(tiff) <= len(replacement) {
+							copy(replacement[4:], tiff)
+						}
+					}
+				}
+			}
+			payload = replacement
+		case "application/rdf+xml":
+			if allow.XMP {
+				continue
+			}
+			payload = bytes.Repeat([]byte(" "), len(payload))
+		default:
+			continue
+		}
+		for _, extent := range extents {
+			copy(out[extent[0]:extent[0]+extent[1]], payload)
+			payload = payload[extent[1]:]
+		}
+	}
+	return out, nil
+}
+
+// heicItemTypes returns the item types listed by an iinf box by item id.
+// The type of mime items is their content type.
+func heicItemTypes(iinf []byte) map[uint32]string {
+	types := map[uint32]string{}
+	if len(iinf) < 6 {
+		return types
+	}
+	entries := iinf[6:]
+	if iinf[0] != 0 {
+		if len(iinf) < 8 {
+			return types
+		}
+		entries = iinf[8:]
+	}
+	for entries != nil {
+		kind, body, rest := nextISOBox(entries)
+		entries = rest
+		if kind != "infe" || len(body) < 4 || body[0] < 2 {
+			continue
+		}
+		var id uint32
+		fields := body[4:]
+		if body[0] == 2 {
+			if len(fields) < 8 {
+				continue
+			}
+			id, fields = uint32(binary.BigEndian.Uint16(fields)), fields[2:]
+		} else {
+			if len(fields) < 10 {
+				continue
+			}
+			id, fields = binary.BigEndian.Uint32(fields), fields[4:]
+		}
+		// Skip item_protection_index.
+		itemType, fields := string(fields[2:6]), fields[6:]
+		if itemType == "mime" {
+			// item_name, then content_type, both NUL terminated.
+			if name := bytes.IndexByte(fields, 0); name >= 0 {
+				contentType := fields[name+1:]
+				if end := bytes.IndexByte(contentType, 0); end >= 0 {
+					itemType = string(contentType[:end])
+				}
+			}
+		}
+		types[id] = itemType
+	}
+	return types
+}
+
+// heicItemLocations returns the extents, as offset and length, of the items
+// an iloc box locates by file offset.
+func heicItemLocations(iloc []byte, fileSize int) (map[uint32][][2]int, error) {
+	locations := map[uint32][][2]int{}
+	if len(iloc) < 8 {
+		return nil, ErrInvalidImage
+	}
+	version := iloc[0]
+	offsetSize, lengthSize := int(iloc[4]>>4), int(iloc[4]&0x0f)
+	baseOffsetSize, indexSize := int(iloc[5]>>4), int(iloc[5]&0x0f)
+	if version == 0 {
+		indexSize = 0
+	}
+	r := &isoReader{data: iloc[6:]}
+	itemCount := r.uint(2)
+	if version >= 2 {
+		itemCount = r.uint(4)
+	}
+	for i := uint64(0); i < itemCount && r.err == nil; i++ {
+		id := r.uint(2)
+		if version >= 2 {
+			id = r.uint(4)
+		}
+		method := uint64(0)
+		if version >= 1 {
+			method = r.uint(2) & 0x0f
+		}
+		r.uint(2) // data_reference_index
+		base := r.uint(baseOffsetSize)
+		extentCount := r.uint(2)
+		extents := [][2]int{}
+		for j := uint64(0); j < extentCount && r.err == nil; j++ {
+			r.uint(indexSize)
+			extentOffset, length := r.uint(offsetSize), r.uint(lengthSize)
+			// Fields are up to 8 bytes wide, so the sums could overflow.
+			if base > math.MaxUint64-extentOffset {
+				return nil, ErrInvalidImage
+			}
+			offset, size := base+extentOffset, uint64(fileSize)
+			if offset > size || length > size-offset {
+				return nil, ErrInvalidImage
+			}
+			extents = append(extents, [2]int{int(offset), int(length)})
+		}
+		// Items stored in idat or derived from other items are left alone.
+		if method == 0 {
+			locations[uint32(id)] = extents
+		}
+	}
+	if r.err != nil {
+		return nil, ErrInvalidImage
+	}
+	return locations, nil
+}
+
+// isoReader reads big endian integers of varying size from a box body.
+type isoReader struct {
+	data []byte
+	err  error
+}
+
+func (r *isoReader) uint(size int) uint64 {
+	if size == 0 || r.err != nil {
+		return 0
+	}
+	if size > len(r.data) || size > 8 {
+		r.err = ErrInvalidImage
+		return 0
+	}
+	value := uint64(0)
+	for _, b := range r.data[:size] {
+		value = value<<8 | uint64(b)
+	}
+	r.data = r.data[size:]
+	return value
+}
+
+// orient applies an EXIF orientation to img, returning an image that
+// displays upright without it. Besides the result, only one row of img is
+// converted at a time, so memory stays bounded by the result.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	row := image.NewRGBA(image.Rect(0, 0, width, 1))
+	for y := 0; y < height; y++ {
+		draw.Draw(row, row.Bounds(), img, image.Pt(bounds.Min.X, bounds.Min.Y+y), draw.Src)
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = width-1-x, y
+			case 3: // rotated 180°
+				dx, dy = width-1-x, height-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, height-1-y
+			case 5: // mirrored along the main diagonal
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise to display
+				dx, dy = height-1-y, x
+			case 7: // mirrored along the anti-diagonal
+				dx, dy = height-1-y, width-1-x
+			case 8: // rotated 90° counter-clockwise to display
+				dx, dy = y, width-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):], row.Pix[4*x:4*x+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"reflect"
+	"testing"
+)
+
+func TestOrient(t *testing.T) {
+	// Pixels are numbered row by row:
+	//   1 2 3
+	//   4 5 6
+	src := image.NewGray(image.Rect(10, 20, 13, 22))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i + 1)
+	}
+	for _, tc := range []struct {
+		orientation int
+		want        [][]uint8
+	}{
+		{2, [][]uint8{{3, 2, 1}, {6, 5, 4}}},
+		{3, [][]uint8{{6, 5, 4}, {3, 2, 1}}},
+		{4, [][]uint8{{4, 5, 6}, {1, 2, 3}}},
+		{5, [][]uint8{{1, 4}, {2, 5}, {3, 6}}},
+		{6, [][]uint8{{4, 1}, {5, 2}, {6, 3}}},
+		{7, [][]uint8{{6, 3}, {5, 2}, {4, 1}}},
+		{8, [][]uint8{{3, 6}, {2, 5}, {1, 4}}},
+	} {
+		img := orient(src, tc.orientation)
+		bounds := img.Bounds()
+		got := [][]uint8{}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			row := []uint8{}
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				row = append(row, color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			}
+			got = append(got, row)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("orientation %d: got %v, want %v", tc.orientation, got, tc.want)
+		}
+	}
+	if img := orient(src, 1); img != image.Image(src) {
+		t.Errorf("orientation 1: got a copy")
+	}
+}
+
+// orientedJPEG returns a width x height JPEG with an EXIF orientation.
+func orientedJPEG(t *testing.T, width, height int, orientation uint16) []byte {
+	encoded := &bytes.Buffer{}
+	if err := jpeg.Encode(encoded, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, byte(orientation >> 8), byte(orientation), 0, 0, 0, 0, 0, 0}
+	data := []byte{0xff, 0xd8}
+	data = append(data, jpegSegment(0xe1, append([]byte("Exif\x00\x00"), tiff...))...)
+	return append(data, encoded.Bytes()[2:]...)
+}
+
+func TestStripJPEGOrientation(t *testing.T) {
+	data := orientedJPEG(t, 40, 20, 6)
+	info := &imageInfo{Format: "jpeg"}
+	out, err := stripMetadata(data, info, MetadataAllowList{}, 40*20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 20 || info.Height != 40 || info.Size != int64(len(out)) {
+		t.Errorf("got %+v, want 20x40", info)
+	}
+
+	// Images are not decoded for orienting beyond the pixel limit.
+	if _, err := stripMetadata(data, &imageInfo{Format: "jpeg"}, MetadataAllowList{}, 40*20-1); err != ErrImageDimensions {
+		t.Errorf("got %v, want ErrImageDimensions", err)
+	}
+}
+
+// heicWithExtent returns a HEIC file whose only item, an Exif block, is
+// located at base+offset with the given length.
+func heicWithExtent(base, offset, length uint64) []byte {
+	box := func(kind string, body []byte) []byte {
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint32(header, uint32(8+len(body)))
+		copy(header[4:], kind)
+		return append(header, body...)
+	}
+	u16 := func(v uint16) []byte { return []byte{byte(v >> 8), byte(v)} }
+	u64 := func(v uint64) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		return b
+	}
+
+	// Version 0 with 8 byte offsets, lengths and base offsets.
+	iloc := []byte{0, 0, 0, 0, 0x88, 0x80}
+	iloc = append(iloc, u16(1)...) // item count
+	iloc = append(iloc, u16(1)...) // item id
+	iloc = append(iloc, u16(0)...) // data reference index
+	iloc = append(iloc, u64(base)...)
+	iloc = append(iloc, u16(1)...) // extent count
+	iloc = append(iloc, u64(offset)...)
+	iloc = append(iloc, u64(length)...)
+
+	infe := append([]byte{2, 0, 0, 0}, u16(1)...)
+	infe = append(infe, u16(0)...)
+	infe = append(infe, "Exif"...)
+	iinf := append([]byte{0, 0, 0, 0}, u16(1)...)
+	iinf = append(iinf, box("infe", infe)...)
+
+	meta := append([]byte{0, 0, 0, 0}, box("iinf", iinf)...)
+	meta = append(meta, box("iloc", iloc)...)
+	data := box("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	return append(data, box("meta", meta)...)
+}
+
+func TestStripHEICExtentBounds(t *testing.T) {
+	for _, tc := range []struct {
+		name                 string
+		base, offset, length uint64
+	}{
+		{"offset overflowing", 0, 0xffffffffffffffff, 1},
+		{"base and offset overflowing", 0xfffffffffffffff0, 0x20, 1},
+		{"length overflowing", 0, 16, 0xffffffffffffffff},
+		{"past the end", 0, 16, 1 << 20},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := heicWithExtent(tc.base, tc.offset, tc.length)
+			if _, err := stripMetadata(data, &imageInfo{Format: "heic"}, MetadataAllowList{}, 0); err != ErrInvalidImage {
+				t.Errorf("got %v, want ErrInvalidImage", err)
+			}
+		})
+	}
+
+	data := heicWithExtent(8, 8, 4)
+	locations, err := heicItemLocations(isoBox(isoBox(data, "meta")[4:], "iloc"), len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][2]int{{16, 4}}; !reflect.DeepEqual(locations[1], want) {
+		t.Errorf("got %v, want %v", locations[1], want)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"gorm.io/gorm"
+	"time"
+)
+
+var (
+	ErrJobRunning = errors.New("job is running")
+)
+
+const (
+	JobStatusQueued  = "queued"
+	JobStatusRunning = "running"
+	JobStatusDone    = "done"
+	JobStatusFailed  = "failed"
+)
+
+// ProcessingJob is an entry of the processing outbox: a request to have a
+// photo processed. It is written in the same transaction as the photo, so
+// every stored photo gets processed even if the service restarts right after
+// the upload.
+type ProcessingJob struct {
+	IdJob   uint  `json:"id" gorm:"primaryKey"`
+	IdPhoto uint  `json:"id_photo" gorm:"index"`
+	Photo   Photo `json:"-" gorm:"foreignKey:IdPhoto;constraint:OnDelete:CASCADE"`
+	// RequestId is sent along to the image processor as request-id
+	// metadata.
+	RequestId     string     `json:"request_id"`
+	Status        string     `json:"status" gorm:"index"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt time.Time  `json:"next_attempt_at" gorm:"index"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+func (ProcessingJob) TableName() string {
+	return "t_processing_job"
+}
+
+// JobQuery selects processing jobs for operators. Zero valued fields do not
+// filter. Jobs are listed newest first.
+type JobQuery struct {
+	Status  string `json:"status,omitempty"`
+	IdPhoto uint   `json:"id_photo,omitempty"`
+	Limit   int    `json:"limit,omitempty"`
+	Cursor  string `json:"cursor,omitempty"`
+}
+
+func newProcessingJob(photo Photo, requestId string) ProcessingJob {
+	return ProcessingJob{
+		IdPhoto:       photo.IdPhoto,
+		RequestId:     requestId,
+		Status:        JobStatusQueued,
+		NextAttemptAt: time.Now(),
+	}
+}
+
+// migrateOutbox queues jobs for photos that were awaiting processing before
+// the outbox existed.
+func migrateOutbox(db *gorm.DB) error {
+	return db.Exec("INSERT INTO t_processing_job (id_photo, request_id, status, attempts, next_attempt_at, created_at, updated_at) "+
+		"SELECT id_photo, '', ?, 0, now(), now(), now() FROM t_photo p WHERE status IN ? "+
+		"AND NOT EXISTS (SELECT 1 FROM t_processing_job j WHERE j.id_photo = p.id_photo)",
+		JobStatusQueued, []string{PhotoStatusPending, PhotoStatusProcessing}).Error
+}
+
+func (s adService) ListProcessingJobs(ctx context.Context, query JobQuery) ([]ProcessingJob, string, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	logContext, _ := json.Marshal(query)
+	level.Info(logger).Log("msg", "ListProcessingJobs request received", "context", logContext)
+
+	cursor, err := decodePageCursor(query.Cursor, "-id")
+	if err != nil {
+		level.Error(logger).Log("context", "ListProcessingJobs", "msg", err)
+		return nil, "", err
+	}
+	tx := s.db.Model(&ProcessingJob{})
+	if query.Status != "" {
+		tx = tx.Where("status = ?", query.Status)
+	}
+	if query.IdPhoto != 0 {
+		tx = tx.Where("id_photo = ?", query.IdPhoto)
+	}
+	if cursor != nil {
+		tx = tx.Where("id_job < ?", cursor.ID)
+	}
+
+	size := pageSize(query.Limit)
+	jobs := []ProcessingJob{}
+	if result := tx.Order("id_job desc").Limit(size + 1).Find(&jobs); result.Error != nil {
+		level.Error(logger).Log("context", "ListProcessingJobs", "msg", result.Error)
+		return nil, "", result.Error
+	}
+	next := ""
+	if len(jobs) > size {
+		jobs = jobs[:size]
+		next = pageCursor{Sort: "-id", ID: jobs[size-1].IdJob}.encode()
+	}
+	return jobs, next, nil
+}
+
+func (s adService) ReplayProcessingJob(ctx context.Context, id uint) (*ProcessingJob, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "ReplayProcessingJob request received", "context", fmt.Sprintf("\"id\":%d", id))
+	markPrivileged(ctx, fmt.Sprintf("job/%d", id))
+
+	var job ProcessingJob
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.First(&job, id)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+		if job.Status == JobStatusRunning && job.LockedUntil != nil && job.LockedUntil.After(time.Now()) {
+			return ErrJobRunning
+		}
+		job.Status = JobStatusQueued
+		job.Attempts = 0
+		job.LastError = ""
+		job.NextAttemptAt = time.Now()
+		job.LockedUntil = nil
+		if result := tx.Save(&job); result.Error != nil {
+			return result.Error
+		}
+		return tx.Model(&Photo{}).Where("id_photo = ?", job.IdPhoto).
+			Updates(map[string]interface{}{"status": PhotoStatusProcessing, "status_message": ""}).Error
+	})
+	if err != nil {
+		level.Error(logger).Log("context", "ReplayProcessingJob", "msg", err)
+		return nil, err
+	}
+
+	s.processor.Notify()
+	return &job, nil
+}
@@ -18,6 +18,9 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type ImageProcessorServiceClient interface {
 	Process(ctx context.Context, in *Image, opts ...grpc.CallOption) (*Status, error)
+	// ProcessStream does what Process does, reporting progress as it goes.
+	// The last message carries the Status.
+	ProcessStream(ctx context.Context, in *Image, opts ...grpc.CallOption) (ImageProcessorService_ProcessStreamClient, error)
 }
 
 type imageProcessorServiceClient struct {
@@ -37,11 +40,46 @@ func (c *imageProcessorServiceClient) Process(ctx context.Context, in *Image, op
 	return out, nil
 }
 
+func (c *imageProcessorServiceClient) ProcessStream(ctx context.Context, in *Image, opts ...grpc.CallOption) (ImageProcessorService_ProcessStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_ImageProcessorService_serviceDesc.Streams[0], "/ImageProcessorService/ProcessStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &imageProcessorServiceProcessStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ImageProcessorService_ProcessStreamClient interface {
+	Recv() (*Progress, error)
+	grpc.ClientStream
+}
+
+type imageProcessorServiceProcessStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *imageProcessorServiceProcessStreamClient) Recv() (*Progress, error) {
+	m := new(Progress)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // ImageProcessorServiceServer is the server API for ImageProcessorService service.
 // All implementations must embed UnimplementedImageProcessorServiceServer
 // for forward compatibility
 type ImageProcessorServiceServer interface {
 	Process(context.Context, *Image) (*Status, error)
+	// ProcessStream does what Process does, reporting progress as it goes.
+	// The last message carries the Status.
+	ProcessStream(*Image, ImageProcessorService_ProcessStreamServer) error
 	mustEmbedUnimplementedImageProcessorServiceServer()
 }
 
@@ -52,6 +90,9 @@ type UnimplementedImageProcessorServiceServer struct {
 func (UnimplementedImageProcessorServiceServer) Process(context.Context, *Image) (*Status, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Process not implemented")
 }
+func (UnimplementedImageProcessorServiceServer) ProcessStream(*Image, ImageProcessorService_ProcessStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method ProcessStream not implemented")
+}
 func (UnimplementedImageProcessorServiceServer) mustEmbedUnimplementedImageProcessorServiceServer() {}
 
 // UnsafeImageProcessorServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -83,6 +124,27 @@ func _ImageProcessorService_Process_Handler(srv interface{}, ctx context.Context
 	return interceptor(ctx, in, info, handler)
 }
 
+func _ImageProcessorService_ProcessStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(Image)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ImageProcessorServiceServer).ProcessStream(m, &imageProcessorServiceProcessStreamServer{stream})
+}
+
+type ImageProcessorService_ProcessStreamServer interface {
+	Send(*Progress) error
+	grpc.ServerStream
+}
+
+type imageProcessorServiceProcessStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *imageProcessorServiceProcessStreamServer) Send(m *Progress) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 var _ImageProcessorService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "ImageProcessorService",
 	HandlerType: (*ImageProcessorServiceServer)(nil),
@@ -92,6 +154,12 @@ var _ImageProcessorService_serviceDesc = grpc.ServiceDesc{
 			Handler:    _ImageProcessorService_Process_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ProcessStream",
+			Handler:       _ImageProcessorService_ProcessStream_Handler,
+			ServerStreams: true,
+		},
+	},
 	Metadata: "pb/image-processor.proto",
 }
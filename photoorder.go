@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"gorm.io/gorm"
+	"time"
+)
+
+// migratePhotoOrder allows one cover photo per ad, and numbers and picks a
+// cover for photos stored before they had a position.
+func migratePhotoOrder(db *gorm.DB) error {
+	if err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_photo_ad_cover ON t_photo (id_ad) WHERE cover").Error; err != nil {
+		return err
+	}
+	// Only ads whose photos share a position are renumbered, which keeps
+	// orders set by ReorderPhotos.
+	err := db.Exec(`UPDATE t_photo p SET position = o.n FROM (
+		SELECT id_photo, row_number() OVER (PARTITION BY id_ad ORDER BY position, id_photo) - 1 AS n FROM t_photo
+		WHERE id_ad IN (SELECT id_ad FROM t_photo GROUP BY id_ad HAVING count(DISTINCT position) < count(*))
+	) o WHERE p.id_photo = o.id_photo`).Error
+	if err != nil {
+		return err
+	}
+	return db.Exec(`UPDATE t_photo SET cover = true WHERE id_photo IN (
+		SELECT DISTINCT ON (id_ad) id_photo FROM t_photo
+		WHERE id_ad NOT IN (SELECT id_ad FROM t_photo WHERE cover)
+		ORDER BY id_ad, position, id_photo
+	)`).Error
+}
+
+// lockAd serializes the transactions changing the order or the cover of the
+// photos of an ad. The lock is held until the transaction ends.
+func lockAd(tx *gorm.DB, adId uint) error {
+	return tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", fmt.Sprintf("ad/%d", adId)).Error
+}
+
+// BeforeCreate puts a new photo last in the order of its ad, and makes it
+// the cover if the ad has none. It runs in the transaction creating the
+// photo.
+func (photo *Photo) BeforeCreate(tx *gorm.DB) error {
+	// A new statement, so the insert being prepared is left alone.
+	tx = tx.Session(&gorm.Session{NewDB: true})
+	if err := lockAd(tx, photo.IdAd); err != nil {
+		return err
+	}
+	var order struct {
+		Next   int
+		Covers int
+	}
+	err := tx.Raw("SELECT COALESCE(MAX(position) + 1, 0) AS next, COUNT(*) FILTER (WHERE cover) AS covers FROM t_photo WHERE id_ad = ?",
+		photo.IdAd).Scan(&order).Error
+	if err != nil {
+		return err
+	}
+	photo.Position = order.Next
+	photo.Cover = order.Covers == 0
+	return nil
+}
+
+// promoteCover makes the first photo of an ad its cover, after the cover
+// was deleted.
+func promoteCover(tx *gorm.DB, adId uint) error {
+	return tx.Exec("UPDATE t_photo SET cover = true WHERE id_photo = "+
+		"(SELECT id_photo FROM t_photo WHERE id_ad = ? ORDER BY position, id_photo LIMIT 1)", adId).Error
+}
+
+// coverPhotos returns the cover photos of ads, by ad id.
+func (s adService) coverPhotos(adIds []uint) (map[uint]*Photo, error) {
+	covers := map[uint]*Photo{}
+	if len(adIds) == 0 {
+		return covers, nil
+	}
+	photos := []Photo{}
+	if result := s.db.Preload("Variants").Where("id_ad IN ? AND cover", adIds).Find(&photos); result.Error != nil {
+		return nil, result.Error
+	}
+	for i := range photos {
+		covers[photos[i].IdAd] = &photos[i]
+	}
+	return covers, nil
+}
+
+// ReorderPhotos sets the order of the photos of an ad, which photoIds must
+// list all of, once each.
+func (s adService) ReorderPhotos(ctx context.Context, adId uint, photoIds []uint) ([]Photo, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "ReorderPhotos request received", "context", fmt.Sprintf("\"id\":%d,\"photo_ids\":%v", adId, photoIds))
+
+	if err := s.authorizeAd(ctx, adId); err != nil {
+		level.Error(logger).Log("context", "ReorderPhotos", "msg", err)
+		return nil, err
+	}
+
+	photos := []Photo{}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockAd(tx, adId); err != nil {
+			return err
+		}
+		existing := []uint{}
+		if result := tx.Model(&Photo{}).Where("id_ad = ?", adId).Pluck("id_photo", &existing); result.Error != nil {
+			return result.Error
+		}
+		listed := map[uint]bool{}
+		for _, id := range photoIds {
+			listed[id] = true
+		}
+		if len(listed) != len(photoIds) || len(photoIds) != len(existing) {
+			return ErrInconsistentIDs
+		}
+		for _, id := range existing {
+			if !listed[id] {
+				return ErrInconsistentIDs
+			}
+		}
+		for position, id := range photoIds {
+			if result := tx.Model(&Photo{}).Where("id_photo = ?", id).Update("position", position); result.Error != nil {
+				return result.Error
+			}
+		}
+		return tx.Preload("Variants").Where("id_ad = ?", adId).Order("position, id_photo").Find(&photos).Error
+	})
+	if err != nil {
+		level.Error(logger).Log("context", "ReorderPhotos", "msg", err)
+		return nil, err
+	}
+	return photos, nil
+}
+
+// SetCoverPhoto makes a photo the cover of its ad, in place of the previous
+// one.
+func (s adService) SetCoverPhoto(ctx context.Context, adId uint, id uint) (*Photo, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "SetCoverPhoto request received", "context", fmt.Sprintf("\"id\":%d,\"id_photo\":%d", adId, id))
+
+	if err := s.authorizeAd(ctx, adId); err != nil {
+		level.Error(logger).Log("context", "SetCoverPhoto", "msg", err)
+		return nil, err
+	}
+
+	var photo Photo
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockAd(tx, adId); err != nil {
+			return err
+		}
+		result := tx.Preload("Variants").Where("id_photo = ? AND id_ad = ?", id, adId).First(&photo)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Model(&Photo{}).Where("id_ad = ? AND cover", adId).Update("cover", false); result.Error != nil {
+			return result.Error
+		}
+		photo.Cover = true
+		return tx.Model(&Photo{}).Where("id_photo = ?", id).Update("cover", true).Error
+	})
+	if err != nil {
+		level.Error(logger).Log("context", "SetCoverPhoto", "msg", err)
+		return nil, err
+	}
+	return &photo, nil
+}
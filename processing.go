@@ -0,0 +1,350 @@
+package main
+
+import (
+	"ad-manager/pb"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"google.golang.org/grpc"
+	"gorm.io/gorm"
+	"math/rand"
+	"time"
+)
+
+const (
+	// PhotoStatusPending photos wait for the image processor, either queued
+	// or backing off after a failed attempt.
+	PhotoStatusPending    = "pending"
+	PhotoStatusProcessing = "processing"
+	PhotoStatusReady      = "ready"
+	// PhotoStatusFailed photos could not be processed; StatusMessage says
+	// why.
+	PhotoStatusFailed = "failed"
+)
+
+const (
+	// processingLease is how long a claimed job is reserved for the worker
+	// that claimed it. Jobs of workers that died are claimed again after it.
+	processingLease = time.Minute
+	// processingPollInterval is how often idle workers look for due jobs.
+	processingPollInterval = 2 * time.Second
+)
+
+// errJobReclaimed is returned by the transaction of finish when another
+// worker claimed the job since.
+var errJobReclaimed = errors.New("job was claimed again by another worker")
+
+// processingVariants are the variants requested for every photo.
+var processingVariants = []*pb.VariantSpec{
+	{Name: VariantThumbnail, MaxWidth: 200, MaxHeight: 200, Format: "jpeg"},
+	{Name: VariantMedium, MaxWidth: 800, MaxHeight: 800, Format: "jpeg"},
+	{Name: VariantLarge, MaxWidth: 1600, MaxHeight: 1600, Format: "jpeg"},
+	{Name: VariantWebP, MaxWidth: 1600, MaxHeight: 1600, Format: "webp"},
+}
+
+// processingError is a failure reported by the image processor itself, as
+// opposed to one calling it.
+type processingError struct {
+	Code    pb.ErrorCode
+	Message string
+}
+
+func (e processingError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// retryable tells whether the processor may succeed on a later attempt.
+// ImageNotFound is included since the original may not be visible to the
+// processor yet on eventually consistent storage.
+func (e processingError) retryable() bool {
+	switch e.Code {
+	case pb.ErrorCode_ImageNotFound, pb.ErrorCode_StorageUnavailable, pb.ErrorCode_InternalError:
+		return true
+	default:
+		return false
+	}
+}
+
+// photoProcessor runs the jobs of the processing outbox. A pool of workers
+// claims due jobs from t_processing_job, calls ImageProcessorService.Process
+// and records the outcome on both the job and the photo. Transient failures
+// are retried with jittered exponential backoff. Since jobs live in the
+// database, they survive restarts and are delivered at least once.
+type photoProcessor struct {
+	logger         log.Logger
+	db             *gorm.DB
+	blobStore      BlobStore
+	client         *processorClient
+	wake           chan struct{}
+	maxAttempts    int
+	storageBackend string
+	storageBucket  string
+	progress       *progressHub
+}
+
+func newPhotoProcessor(logger log.Logger, db *gorm.DB, blobStore BlobStore, grpcConn *grpc.ClientConn, progress *progressHub, config ServiceConfig) *photoProcessor {
+	return &photoProcessor{
+		logger:         log.With(logger, "component", "photoProcessor"),
+		db:             db,
+		blobStore:      blobStore,
+		client:         newProcessorClient(logger, grpcConn, config),
+		wake:           make(chan struct{}, 1),
+		maxAttempts:    config.ProcessingMaxAttempts,
+		storageBackend: config.StorageBackend,
+		storageBucket:  config.StorageBucket,
+		progress:       progress,
+	}
+}
+
+// Start launches the workers.
+func (p *photoProcessor) Start(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		go p.work(ctx)
+	}
+}
+
+// Notify tells an idle worker that a job was queued, so it does not wait for
+// the next poll.
+func (p *photoProcessor) Notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *photoProcessor) work(ctx context.Context) {
+	for {
+		job, err := p.claim()
+		if err != nil {
+			level.Error(p.logger).Log("context", "work", "msg", err)
+		}
+		if job != nil {
+			p.handle(*job)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wake:
+		case <-time.After(processingPollInterval):
+		}
+	}
+}
+
+// claim reserves the next due job: a queued job whose backoff is over or a
+// running job whose lease expired. It returns nil if there is none.
+func (p *photoProcessor) claim() (*ProcessingJob, error) {
+	now := time.Now()
+	jobs := []ProcessingJob{}
+	result := p.db.Raw("UPDATE t_processing_job SET status = ?, attempts = attempts + 1, locked_until = ?, updated_at = ? "+
+		"WHERE id_job = (SELECT id_job FROM t_processing_job "+
+		"WHERE (status = ? AND next_attempt_at <= ?) OR (status = ? AND locked_until < ?) "+
+		"ORDER BY next_attempt_at, id_job LIMIT 1 FOR UPDATE SKIP LOCKED) RETURNING *",
+		JobStatusRunning, now.Add(processingLease), now,
+		JobStatusQueued, now, JobStatusRunning, now).Scan(&jobs)
+	if result.Error != nil || len(jobs) == 0 {
+		return nil, result.Error
+	}
+	return &jobs[0], nil
+}
+
+func (p *photoProcessor) handle(job ProcessingJob) {
+	logger := log.With(p.logger, "request-id", job.RequestId, "job", job.IdJob, "id", job.IdPhoto, "attempt", job.Attempts)
+
+	var photo Photo
+	result := p.db.First(&photo, job.IdPhoto)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		p.finish(logger, job, JobStatusFailed, ErrNotFound.Error(), photo, "", nil)
+		return
+	}
+	if result.Error != nil {
+		level.Error(logger).Log("context", "handle", "msg", result.Error)
+		p.finish(logger, job, JobStatusQueued, result.Error.Error(), photo, "", nil)
+		return
+	}
+	p.db.Model(&photo).Updates(map[string]interface{}{"status": PhotoStatusProcessing, "status_message": ""})
+	p.progress.Publish(PhotoProgress{Event: ProgressEventStatus, IdPhoto: photo.IdPhoto, Status: PhotoStatusProcessing})
+
+	reply, retryable, err := p.process(job.RequestId, photo)
+	photo.ErrorCode = ""
+	var processingErr processingError
+	if errors.As(err, &processingErr) {
+		photo.ErrorCode = processingErr.Code.String()
+	}
+	switch {
+	case err == nil:
+		photo.Width, photo.Height, photo.Format = uint(reply.Width), uint(reply.Height), reply.Format
+		p.finish(logger, job, JobStatusDone, "", photo, PhotoStatusReady, p.variants(logger, photo, reply))
+	case retryable && job.Attempts < p.maxAttempts:
+		level.Error(logger).Log("context", "handle", "msg", err)
+		p.finish(logger, job, JobStatusQueued, err.Error(), photo, PhotoStatusPending, nil)
+	default:
+		level.Error(logger).Log("context", "handle", "msg", err)
+		p.finish(logger, job, JobStatusFailed, err.Error(), photo, PhotoStatusFailed, nil)
+	}
+}
+
+// variants turns the variants of a processor reply into PhotoVariants.
+// Variants the processor failed to produce are logged and left out.
+func (p *photoProcessor) variants(logger log.Logger, photo Photo, reply *pb.Status) []PhotoVariant {
+	variants := []PhotoVariant{}
+	for _, variant := range reply.Variants {
+		if variant.Code == pb.StatusCode_Failed {
+			level.Error(logger).Log("context", "variants", "variant", variant.Name, "msg", processingError{Code: variant.Error, Message: variant.Message})
+			continue
+		}
+		if photoVariant, ok := p.variant(photo, variant); ok {
+			variants = append(variants, photoVariant)
+		}
+	}
+	return variants
+}
+
+// variant turns a variant reported by the processor into a PhotoVariant. It
+// returns false for variants lacking a name or object.
+func (p *photoProcessor) variant(photo Photo, variant *pb.Variant) (PhotoVariant, bool) {
+	if variant.Name == "" || variant.ObjectName == "" {
+		return PhotoVariant{}, false
+	}
+	return PhotoVariant{
+		IdPhoto:     photo.IdPhoto,
+		Name:        variant.Name,
+		ObjectName:  variant.ObjectName,
+		Url:         p.blobStore.URL(variant.ObjectName),
+		Width:       uint(variant.Width),
+		Height:      uint(variant.Height),
+		ContentType: variant.ContentType,
+	}, true
+}
+
+// finish records the outcome of an attempt on the job and, unless
+// photoStatus is empty, on the photo along with the photo's error code and
+// detected dimensions and format. Queued jobs are scheduled after a backoff.
+// Non-nil variants replace those stored for the photo. Nothing is recorded
+// if the job was reclaimed after its lease expired: the outcome is then the
+// business of the worker holding it now.
+func (p *photoProcessor) finish(logger log.Logger, job ProcessingJob, jobStatus string, message string, photo Photo, photoStatus string, variants []PhotoVariant) {
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]interface{}{"status": jobStatus, "last_error": message, "locked_until": nil}
+		if jobStatus == JobStatusQueued {
+			updates["next_attempt_at"] = time.Now().Add(processingBackoff(job.Attempts))
+		}
+		result := tx.Model(&job).Where("status = ? AND attempts = ?", JobStatusRunning, job.Attempts).Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errJobReclaimed
+		}
+		if variants != nil {
+			if result := tx.Where("id_photo = ?", photo.IdPhoto).Delete(&PhotoVariant{}); result.Error != nil {
+				return result.Error
+			}
+			if len(variants) > 0 {
+				if result := tx.Create(&variants); result.Error != nil {
+					return result.Error
+				}
+			}
+		}
+		if photoStatus == "" {
+			return nil
+		}
+		return tx.Model(&photo).Updates(map[string]interface{}{
+			"status":         photoStatus,
+			"status_message": message,
+			"error_code":     photo.ErrorCode,
+			"width":          photo.Width,
+			"height":         photo.Height,
+			"format":         photo.Format,
+		}).Error
+	})
+	if err == errJobReclaimed {
+		level.Info(logger).Log("context", "finish", "msg", err)
+		return
+	}
+	if err != nil {
+		level.Error(logger).Log("context", "finish", "msg", err)
+		return
+	}
+	if photoStatus != "" {
+		p.progress.Publish(PhotoProgress{Event: ProgressEventStatus, IdPhoto: photo.IdPhoto, Status: photoStatus, StatusMessage: message})
+	}
+}
+
+// process asks the image processor to process a photo, relaying its
+// progress to watchers. When it fails, retryable tells whether trying again
+// later may succeed.
+func (p *photoProcessor) process(requestId string, photo Photo) (reply *pb.Status, retryable bool, err error) {
+	// Retries end with the lease, so the job is not claimed again while it
+	// is still being processed.
+	ctx, cancel := context.WithTimeout(context.Background(), processingLease)
+	defer cancel()
+	reply, err = p.client.Process(ctx, processRequest{
+		RequestId: requestId,
+		Image:     p.image(photo),
+		OnProgress: func(progress *pb.Progress) {
+			p.publishProgress(photo, progress)
+		},
+	})
+	if err != nil {
+		return nil, retryableProcessorError(err), err
+	}
+	if reply.Code != pb.StatusCode_Ok {
+		if reply.Error != pb.ErrorCode_NoError {
+			err := processingError{Code: reply.Error, Message: reply.Message}
+			return nil, err.retryable(), err
+		}
+		return nil, false, fmt.Errorf("received non 200 response code %d: %s", reply.Code, reply.Message)
+	}
+	return reply, false, nil
+}
+
+// publishProgress relays progress reported by the processor to watchers.
+func (p *photoProcessor) publishProgress(photo Photo, progress *pb.Progress) {
+	event := PhotoProgress{
+		Event:   ProgressEventProgress,
+		IdPhoto: photo.IdPhoto,
+		Status:  PhotoStatusProcessing,
+		Percent: uint(progress.Percent),
+		Stage:   progress.Stage,
+	}
+	if progress.Variant != nil && progress.Variant.Code != pb.StatusCode_Failed {
+		if variant, ok := p.variant(photo, progress.Variant); ok {
+			event.Event = ProgressEventVariant
+			event.Variant = &variant
+		}
+	}
+	p.progress.Publish(event)
+}
+
+// image builds the request for processing a photo.
+func (p *photoProcessor) image(photo Photo) *pb.Image {
+	return &pb.Image{
+		Id: uint32(photo.IdPhoto),
+		Location: &pb.StorageLocation{
+			Backend:    p.storageBackend,
+			Bucket:     p.storageBucket,
+			ObjectName: photo.ObjectName,
+			Url:        photo.UrlOriginal,
+		},
+		ContentType: photo.ContentType,
+		AdId:        uint32(photo.IdAd),
+		Variants:    processingVariants,
+	}
+}
+
+// processingBackoff waits about two seconds after the first failed attempt
+// and doubles with each one after, up to five minutes. The wait is jittered
+// by up to half so retries of photos that failed together spread out.
+func processingBackoff(attempt int) time.Duration {
+	backoff := 2 * time.Second
+	for i := 1; i < attempt && backoff < 5*time.Minute; i++ {
+		backoff *= 2
+	}
+	if backoff > 5*time.Minute {
+		backoff = 5 * time.Minute
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
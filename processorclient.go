@@ -0,0 +1,205 @@
+package main
+
+import (
+	"ad-manager/pb"
+	"context"
+	"errors"
+	"github.com/go-kit/kit/circuitbreaker"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/sony/gobreaker"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"math/rand"
+	"time"
+)
+
+const (
+	// processorBreakerFailures consecutive failures open the circuit
+	// breaker, which then rejects calls for processorBreakerOpen before
+	// letting a trial call through.
+	processorBreakerFailures = 5
+	processorBreakerOpen     = 30 * time.Second
+	// processorRetryBackoff is the wait before the first retry of a call.
+	processorRetryBackoff = 200 * time.Millisecond
+)
+
+// processRequest is the request of the processorClient endpoint.
+type processRequest struct {
+	RequestId string
+	Image     *pb.Image
+	// OnProgress, if set, receives the progress reported by ProcessStream.
+	OnProgress func(*pb.Progress)
+}
+
+// processorClient calls ImageProcessorService through a go-kit endpoint.
+// Calls failing with a transient gRPC code are retried with jittered backoff,
+// and a circuit breaker stops calling a processor that keeps failing. The
+// connection is dialed lazily, so a processor that is down does not keep
+// ad-manager from starting.
+type processorClient struct {
+	logger log.Logger
+	conn   *grpc.ClientConn
+	// client calls the processor over conn; it is nil without one.
+	client        pb.ImageProcessorServiceClient
+	breaker       *gobreaker.CircuitBreaker
+	timeout       time.Duration
+	streamTimeout time.Duration
+	endpoint      endpoint.Endpoint
+}
+
+func newProcessorClient(logger log.Logger, conn *grpc.ClientConn, config ServiceConfig) *processorClient {
+	c := &processorClient{
+		logger:        log.With(logger, "component", "processorClient"),
+		conn:          conn,
+		timeout:       config.ProcessorTimeout,
+		streamTimeout: config.ProcessorStreamTimeout,
+	}
+	if conn != nil {
+		c.client = pb.NewImageProcessorServiceClient(conn)
+	}
+	c.breaker = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:    "image-processor",
+		Timeout: processorBreakerOpen,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= processorBreakerFailures
+		},
+		// Only failures that say the processor is unhealthy count; a
+		// rejected request says nothing about it.
+		IsSuccessful: func(err error) bool {
+			return err == nil || !retryableProcessorError(err)
+		},
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			level.Info(c.logger).Log("context", "breaker", "msg", "Circuit breaker state changed", "from", from, "to", to)
+		},
+	})
+	c.endpoint = endpoint.Chain(
+		retryProcessor(config.ProcessorRetries, processorRetryBackoff),
+		circuitbreaker.Gobreaker(c.breaker),
+	)(c.makeEndpoint())
+	return c
+}
+
+// Process processes an image, returning the processor's final Status.
+func (c *processorClient) Process(ctx context.Context, request processRequest) (*pb.Status, error) {
+	response, err := c.endpoint(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return response.(*pb.Status), nil
+}
+
+// makeEndpoint returns an endpoint making a single call. It uses
+// ProcessStream and falls back to Process for processors that predate it.
+func (c *processorClient) makeEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(processRequest)
+		client := c.client
+		if client == nil {
+			return nil, status.Error(codes.Unavailable, "image processor not connected")
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, "request-id", req.RequestId)
+
+		streamCtx, cancel := context.WithTimeout(ctx, c.streamTimeout)
+		defer cancel()
+		reply, err := c.processStream(streamCtx, client, req)
+		if status.Code(err) == codes.Unimplemented {
+			unaryCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+			reply, err = client.Process(unaryCtx, req.Image)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return reply, nil
+	}
+}
+
+// processStream calls ProcessStream and hands the progress it reports to
+// OnProgress until the final status arrives.
+func (c *processorClient) processStream(ctx context.Context, client pb.ImageProcessorServiceClient, req processRequest) (*pb.Status, error) {
+	stream, err := client.ProcessStream(ctx, req.Image)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		progress, err := stream.Recv()
+		if err == io.EOF {
+			return nil, status.Error(codes.Aborted, "progress stream ended without a status")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if progress.Status != nil {
+			return progress.Status, nil
+		}
+		if req.OnProgress != nil {
+			req.OnProgress(progress)
+		}
+	}
+}
+
+// Health reports the state of the connection and the circuit breaker.
+// healthy is false while the processor cannot be reached or the breaker is
+// not closed.
+func (c *processorClient) Health() (state string, healthy bool) {
+	if c.conn == nil {
+		return "not connected", false
+	}
+	if breaker := c.breaker.State(); breaker != gobreaker.StateClosed {
+		return "circuit breaker " + breaker.String(), false
+	}
+	switch connState := c.conn.GetState(); connState {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		return connState.String(), false
+	default:
+		return connState.String(), true
+	}
+}
+
+// retryProcessor retries calls failing with a retryable error up to retries
+// times. The wait doubles from backoff with each retry and is jittered by up
+// to half. Calls the circuit breaker rejected are not retried, since it
+// stays open for longer than that.
+func retryProcessor(retries int, backoff time.Duration) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			wait := backoff
+			for attempt := 0; ; attempt++ {
+				response, err := next(ctx, request)
+				if err == nil || attempt >= retries || !retryableProcessorError(err) || breakerRejected(err) {
+					return response, err
+				}
+				select {
+				case <-ctx.Done():
+					return nil, err
+				case <-time.After(wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))):
+				}
+				wait *= 2
+			}
+		}
+	}
+}
+
+func breakerRejected(err error) bool {
+	return errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests)
+}
+
+// retryableProcessorError tells whether a failed call may succeed when tried
+// again later.
+func retryableProcessorError(err error) bool {
+	if breakerRejected(err) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"ad-manager/pb"
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/sony/gobreaker"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"testing"
+	"time"
+)
+
+// fakeProcessor is an ImageProcessorServiceClient answering ProcessStream
+// with progress, then status or streamErr, and Process with status or
+// processErr.
+type fakeProcessor struct {
+	progress   []*pb.Progress
+	status     *pb.Status
+	streamErr  error
+	processErr error
+
+	streamCalls  int
+	processCalls int
+}
+
+func (p *fakeProcessor) Process(ctx context.Context, in *pb.Image, opts ...grpc.CallOption) (*pb.Status, error) {
+	p.processCalls++
+	if p.processErr != nil {
+		return nil, p.processErr
+	}
+	return p.status, nil
+}
+
+func (p *fakeProcessor) ProcessStream(ctx context.Context, in *pb.Image, opts ...grpc.CallOption) (pb.ImageProcessorService_ProcessStreamClient, error) {
+	p.streamCalls++
+	if p.streamErr != nil {
+		return nil, p.streamErr
+	}
+	messages := append(append([]*pb.Progress{}, p.progress...), &pb.Progress{Status: p.status})
+	return &fakeProgressStream{messages: messages}, nil
+}
+
+type fakeProgressStream struct {
+	grpc.ClientStream
+	messages []*pb.Progress
+}
+
+func (s *fakeProgressStream) Recv() (*pb.Progress, error) {
+	if len(s.messages) == 0 {
+		return nil, io.EOF
+	}
+	message := s.messages[0]
+	s.messages = s.messages[1:]
+	return message, nil
+}
+
+func testProcessorClient(processor *fakeProcessor, retries int) *processorClient {
+	c := newProcessorClient(log.NewNopLogger(), nil, ServiceConfig{
+		ProcessorTimeout:       time.Second,
+		ProcessorStreamTimeout: time.Second,
+		ProcessorRetries:       retries,
+	})
+	c.client = processor
+	return c
+}
+
+func TestProcessorClientStream(t *testing.T) {
+	processor := &fakeProcessor{
+		progress: []*pb.Progress{{Percent: 50, Stage: "resize"}},
+		status:   &pb.Status{Code: pb.StatusCode_Ok, Width: 800, Height: 600},
+	}
+	var progress []*pb.Progress
+	reply, err := testProcessorClient(processor, 0).Process(context.Background(), processRequest{
+		Image:      &pb.Image{Id: 1},
+		OnProgress: func(p *pb.Progress) { progress = append(progress, p) },
+	})
+	if err != nil || reply.Width != 800 {
+		t.Fatalf("got %v, %v", reply, err)
+	}
+	if len(progress) != 1 || progress[0].Percent != 50 {
+		t.Errorf("got progress %v", progress)
+	}
+	if processor.streamCalls != 1 || processor.processCalls != 0 {
+		t.Errorf("got %d stream and %d unary calls, want one stream call", processor.streamCalls, processor.processCalls)
+	}
+}
+
+func TestProcessorClientFallsBackToProcess(t *testing.T) {
+	processor := &fakeProcessor{
+		status:    &pb.Status{Code: pb.StatusCode_Ok, Width: 800},
+		streamErr: status.Error(codes.Unimplemented, "unknown method ProcessStream"),
+	}
+	reply, err := testProcessorClient(processor, 2).Process(context.Background(), processRequest{Image: &pb.Image{Id: 1}})
+	if err != nil || reply.Width != 800 {
+		t.Fatalf("got %v, %v", reply, err)
+	}
+	if processor.streamCalls != 1 || processor.processCalls != 1 {
+		t.Errorf("got %d stream and %d unary calls, want one of each", processor.streamCalls, processor.processCalls)
+	}
+}
+
+func TestProcessorClientRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		err   error
+		calls int
+	}{
+		{"unavailable", status.Error(codes.Unavailable, "down"), 3},
+		{"stream ended early", nil, 3},
+		{"invalid argument", status.Error(codes.InvalidArgument, "bad image"), 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			processor := &fakeProcessor{streamErr: tc.err}
+			if tc.err == nil {
+				// A stream without a status is aborted.
+				processor.status = nil
+			}
+			_, err := testProcessorClient(processor, 2).Process(context.Background(), processRequest{Image: &pb.Image{Id: 1}})
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			if processor.streamCalls != tc.calls {
+				t.Errorf("got %d calls, want %d", processor.streamCalls, tc.calls)
+			}
+		})
+	}
+}
+
+func TestProcessorClientBreaker(t *testing.T) {
+	processor := &fakeProcessor{streamErr: status.Error(codes.InvalidArgument, "bad image")}
+	c := testProcessorClient(processor, 0)
+	ctx := context.Background()
+
+	// Rejected requests say nothing about the processor's health.
+	for i := 0; i < processorBreakerFailures*2; i++ {
+		c.Process(ctx, processRequest{Image: &pb.Image{Id: 1}})
+	}
+	if state := c.breaker.State(); state != gobreaker.StateClosed {
+		t.Fatalf("got breaker %s after invalid requests, want closed", state)
+	}
+
+	processor.streamErr = status.Error(codes.Unavailable, "down")
+	processor.streamCalls = 0
+	for i := 0; i < processorBreakerFailures; i++ {
+		c.Process(ctx, processRequest{Image: &pb.Image{Id: 1}})
+	}
+	if state := c.breaker.State(); state != gobreaker.StateOpen {
+		t.Fatalf("got breaker %s after %d failures, want open", state, processorBreakerFailures)
+	}
+	_, err := c.Process(ctx, processRequest{Image: &pb.Image{Id: 1}})
+	if err != gobreaker.ErrOpenState || processor.streamCalls != processorBreakerFailures {
+		t.Errorf("got %v after %d calls, want the call rejected without reaching the processor", err, processor.streamCalls)
+	}
+	if !retryableProcessorError(err) {
+		t.Errorf("rejected call not retryable")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+// Kinds of PhotoProgress events.
+const (
+	ProgressEventStatus   = "status"
+	ProgressEventProgress = "progress"
+	ProgressEventVariant  = "variant"
+)
+
+// PhotoProgress is an event in the processing of a photo.
+type PhotoProgress struct {
+	// Event is one of the ProgressEvent constants.
+	Event         string `json:"-"`
+	IdPhoto       uint   `json:"id"`
+	Status        string `json:"status,omitempty"`
+	StatusMessage string `json:"status_message,omitempty"`
+	Percent       uint   `json:"percent"`
+	Stage         string `json:"stage,omitempty"`
+	// Variant is the completed variant of variant events.
+	Variant *PhotoVariant `json:"variant,omitempty"`
+}
+
+// progressHub relays the progress of photos processed by this instance to
+// the clients watching them. Events are dropped for subscribers that fall
+// behind; the status is polled from the database anyway.
+type progressHub struct {
+	mu          sync.Mutex
+	subscribers map[uint]map[chan PhotoProgress]struct{}
+}
+
+func newProgressHub() *progressHub {
+	return &progressHub{subscribers: map[uint]map[chan PhotoProgress]struct{}{}}
+}
+
+// Subscribe returns a channel receiving the events of a photo. Calling
+// cancel ends the subscription.
+func (h *progressHub) Subscribe(id uint) (events <-chan PhotoProgress, cancel func()) {
+	ch := make(chan PhotoProgress, 16)
+	h.mu.Lock()
+	if h.subscribers[id] == nil {
+		h.subscribers[id] = map[chan PhotoProgress]struct{}{}
+	}
+	h.subscribers[id][ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subscribers[id], ch)
+		if len(h.subscribers[id]) == 0 {
+			delete(h.subscribers, id)
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *progressHub) Publish(event PhotoProgress) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers[event.IdPhoto] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// progressPollInterval is how often WatchPhoto checks the photo's status in
+// the database, which catches photos processed by other instances.
+const progressPollInterval = 2 * time.Second
+
+func (s adService) WatchPhoto(ctx context.Context, adId uint, id uint) (<-chan PhotoProgress, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "WatchPhoto request received", "context", fmt.Sprintf("\"id\":%d", id))
+
+	// Subscribe before reading the status so no event is missed in between.
+	events, cancel := s.progress.Subscribe(id)
+
+	var photo Photo
+	result := s.db.Where("id_photo = ? AND id_ad = ?", id, adId).First(&photo)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		cancel()
+		level.Error(logger).Log("context", "WatchPhoto", "msg", ErrNotFound)
+		return nil, ErrNotFound
+	}
+	if result.Error != nil {
+		cancel()
+		level.Error(logger).Log("context", "WatchPhoto", "msg", result.Error)
+		return nil, result.Error
+	}
+
+	out := make(chan PhotoProgress)
+	go func() {
+		defer close(out)
+		defer cancel()
+		ticker := time.NewTicker(progressPollInterval)
+		defer ticker.Stop()
+
+		status := ""
+		event := PhotoProgress{Event: ProgressEventStatus, IdPhoto: id, Status: photo.Status, StatusMessage: photo.StatusMessage}
+		for {
+			// Status events are only passed on when the status changed,
+			// since both the hub and polling report them.
+			if event.Event != ProgressEventStatus || event.Status != status {
+				if event.Event == ProgressEventStatus {
+					status = event.Status
+					if status == PhotoStatusReady {
+						event.Percent = 100
+					}
+				}
+				select {
+				case out <- event:
+				case <-ctx.Done():
+					return
+				}
+				if status == PhotoStatusReady || status == PhotoStatusFailed {
+					return
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case event = <-events:
+			case <-ticker.C:
+				var current Photo
+				if result := s.db.Select("status", "status_message").First(&current, id); result.Error != nil {
+					level.Error(logger).Log("context", "WatchPhoto", "msg", result.Error)
+					if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+						return
+					}
+					event = PhotoProgress{Event: ProgressEventStatus, IdPhoto: id, Status: status}
+					continue
+				}
+				event = PhotoProgress{Event: ProgressEventStatus, IdPhoto: id, Status: current.Status, StatusMessage: current.StatusMessage}
+			}
+		}
+	}()
+	return out, nil
+}
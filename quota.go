@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"gorm.io/gorm"
+	"time"
+)
+
+// Names of the quotas.
+const (
+	QuotaPhotosPerAd   = "photos_per_ad"
+	QuotaAdsPerUser    = "ads_per_user"
+	QuotaBytesPerUser  = "bytes_per_user"
+	QuotaPhotosPerHour = "photos_per_hour"
+)
+
+// QuotaKind tells whether a request exceeding a quota may succeed later.
+type QuotaKind int
+
+const (
+	// QuotaLimit bounds what is stored. It holds until something is
+	// deleted.
+	QuotaLimit QuotaKind = iota
+	// QuotaRate bounds what is added within a period. It frees up as time
+	// passes.
+	QuotaRate
+)
+
+// QuotaError is returned when an ad or photo would exceed a quota.
+type QuotaError struct {
+	// Quota is one of the Quota constants.
+	Quota string
+	Limit int64
+	Kind  QuotaKind
+	// RetryAfter is how long until a QuotaRate quota admits the request.
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s is limited to %d", e.Quota, e.Limit)
+}
+
+// Quotas bound what a user may store. Zero values do not limit.
+type Quotas struct {
+	MaxPhotosPerAd int `json:"max_photos_per_ad"`
+	// MaxAdsPerUser bounds the ads a user has at once; deleted ads do not
+	// count.
+	MaxAdsPerUser int `json:"max_ads_per_user"`
+	// MaxBytesPerUser bounds the size of the originals of all photos of a
+	// user's ads, as stored.
+	MaxBytesPerUser int64 `json:"max_bytes_per_user"`
+	// MaxPhotosPerHour bounds the photos added to a user's ads within the
+	// last hour that are still there.
+	MaxPhotosPerHour int `json:"max_photos_per_hour"`
+}
+
+// Usage is what a user stores, along with the quotas.
+type Usage struct {
+	IdUser string `json:"id_user"`
+	Ads    int64  `json:"ads"`
+	Photos int64  `json:"photos"`
+	Bytes  int64  `json:"bytes"`
+	Quotas Quotas `json:"quotas"`
+}
+
+// lockUser serializes the transactions checking the quotas of a user. The
+// lock is held until the transaction ends.
+func lockUser(tx *gorm.DB, idUser string) error {
+	return tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "user/"+idUser).Error
+}
+
+// checkAdQuota fails if the user cannot have another ad. To hold until the
+// ad is created, it is called in the creating transaction.
+func (s adService) checkAdQuota(tx *gorm.DB, idUser string) error {
+	if s.quotas.MaxAdsPerUser <= 0 {
+		return nil
+	}
+	if err := lockUser(tx, idUser); err != nil {
+		return err
+	}
+	var ads int64
+	if result := tx.Model(&Ad{}).Where("id_user = ?", idUser).Count(&ads); result.Error != nil {
+		return result.Error
+	}
+	if ads >= int64(s.quotas.MaxAdsPerUser) {
+		return &QuotaError{Quota: QuotaAdsPerUser, Limit: int64(s.quotas.MaxAdsPerUser)}
+	}
+	return nil
+}
+
+// checkPhotoQuota fails if the ad cannot have another photo of size bytes.
+// To hold until the photo is created, it is called in the creating
+// transaction; uploads call it beforehand as well, to fail early.
+func (s adService) checkPhotoQuota(tx *gorm.DB, adId uint, size int64) error {
+	if s.quotas.MaxPhotosPerAd > 0 {
+		if err := lockAd(tx, adId); err != nil {
+			return err
+		}
+		var photos int64
+		if result := tx.Model(&Photo{}).Where("id_ad = ?", adId).Count(&photos); result.Error != nil {
+			return result.Error
+		}
+		if photos >= int64(s.quotas.MaxPhotosPerAd) {
+			return &QuotaError{Quota: QuotaPhotosPerAd, Limit: int64(s.quotas.MaxPhotosPerAd)}
+		}
+	}
+	if s.quotas.MaxBytesPerUser <= 0 && s.quotas.MaxPhotosPerHour <= 0 {
+		return nil
+	}
+	var ad Ad
+	if result := tx.Select("id_user").First(&ad, adId); result.Error != nil {
+		return result.Error
+	}
+	if err := lockUser(tx, ad.IdUser); err != nil {
+		return err
+	}
+	if s.quotas.MaxBytesPerUser > 0 {
+		var bytes int64
+		result := tx.Raw("SELECT COALESCE(SUM(p.size), 0) FROM t_photo p JOIN t_ad a ON a.id_ad = p.id_ad WHERE a.id_user = ?",
+			ad.IdUser).Scan(&bytes)
+		if result.Error != nil {
+			return result.Error
+		}
+		if bytes+size > s.quotas.MaxBytesPerUser {
+			return &QuotaError{Quota: QuotaBytesPerUser, Limit: s.quotas.MaxBytesPerUser}
+		}
+	}
+	if s.quotas.MaxPhotosPerHour > 0 {
+		// The quota is used up if the hour holds MaxPhotosPerHour photos
+		// already, and frees up an hour after the oldest of them.
+		now := time.Now()
+		var oldest time.Time
+		err := tx.Raw("SELECT p.created_at FROM t_photo p JOIN t_ad a ON a.id_ad = p.id_ad WHERE a.id_user = ? AND p.created_at > ? ORDER BY p.created_at DESC OFFSET ? LIMIT 1",
+			ad.IdUser, now.Add(-time.Hour), s.quotas.MaxPhotosPerHour-1).Row().Scan(&oldest)
+		if err == nil {
+			return &QuotaError{
+				Quota:      QuotaPhotosPerHour,
+				Limit:      int64(s.quotas.MaxPhotosPerHour),
+				Kind:       QuotaRate,
+				RetryAfter: oldest.Add(time.Hour).Sub(now),
+			}
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s adService) GetUsage(ctx context.Context, idUser string) (*Usage, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "GetUsage request received", "context", fmt.Sprintf("\"id_user\":%q", idUser))
+
+	if err := s.authorizeUser(ctx, idUser); err != nil {
+		level.Error(logger).Log("context", "GetUsage", "msg", err)
+		return nil, err
+	}
+
+	usage := Usage{IdUser: idUser, Quotas: s.quotas}
+	if result := s.db.Model(&Ad{}).Where("id_user = ?", idUser).Count(&usage.Ads); result.Error != nil {
+		level.Error(logger).Log("context", "GetUsage", "msg", result.Error)
+		return nil, result.Error
+	}
+	result := s.db.Raw("SELECT COUNT(*) AS photos, COALESCE(SUM(p.size), 0) AS bytes FROM t_photo p JOIN t_ad a ON a.id_ad = p.id_ad WHERE a.id_user = ?",
+		idUser).Scan(&usage)
+	if result.Error != nil {
+		level.Error(logger).Log("context", "GetUsage", "msg", result.Error)
+		return nil, result.Error
+	}
+	return &usage, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"gorm.io/gorm"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions checked by Authorizer. Scoped actions are granted as permissions
+// suffixed with ":own", for the caller's own ads, or ":any", for all of
+// them, e.g. "ad:write:own"; the others are granted as they are. API keys
+// granted "ad:create:any" may also add ads on behalf of users.
+const (
+	ActionAdCreate    = "ad:create"
+	ActionAdWrite     = "ad:write"
+	ActionAdDelete    = "ad:delete"
+	ActionPhotoWrite  = "photo:write"
+	ActionPhotoDelete = "photo:delete"
+	ActionUsageRead   = "usage:read"
+	ActionJobRead     = "job:read"
+	ActionJobReplay   = "job:replay"
+	// ActionAPIKeyManage allows creating, listing, rotating and revoking
+	// API keys.
+	ActionAPIKeyManage = "apikey:manage"
+)
+
+var scopedActions = map[string]bool{
+	ActionAdWrite:     true,
+	ActionAdDelete:    true,
+	ActionPhotoWrite:  true,
+	ActionPhotoDelete: true,
+	ActionUsageRead:   true,
+}
+
+// userAction tells whether action is one users take on their own ads. Calls
+// of the other actions are privileged: they are always audited, and denied
+// to anonymous callers.
+func userAction(action string) bool {
+	return action == ActionAdCreate || scopedActions[action]
+}
+
+// Policy maps roles to the permissions they grant. The permission "*"
+// grants everything.
+type Policy map[string][]string
+
+// DefaultPolicy lets users manage their own ads, moderators edit and take
+// down any ad, and admins do anything.
+var DefaultPolicy = Policy{
+	"user": {
+		ActionAdCreate, ActionAdWrite + ":own", ActionAdDelete + ":own",
+		ActionPhotoWrite + ":own", ActionPhotoDelete + ":own", ActionUsageRead + ":own",
+	},
+	"moderator": {
+		ActionAdCreate, ActionAdWrite + ":any", ActionAdDelete + ":any",
+		ActionPhotoWrite + ":any", ActionPhotoDelete + ":any", ActionUsageRead + ":any",
+		ActionJobRead,
+	},
+	"admin": {"*"},
+}
+
+// ParsePolicy parses a policy from JSON, e.g.
+// {"moderator": ["ad:write:any", "photo:delete:any"]}.
+func ParsePolicy(data string) (Policy, error) {
+	var policy Policy
+	if err := json.Unmarshal([]byte(data), &policy); err != nil {
+		return nil, fmt.Errorf("invalid policy: %v", err)
+	}
+	return policy, nil
+}
+
+// AuditRecord records an action a caller could only take through a
+// privileged permission, such as a moderator editing someone else's ad.
+type AuditRecord struct {
+	IdAuditRecord uint   `json:"id" gorm:"primaryKey"`
+	Subject       string `json:"subject" gorm:"index"`
+	Roles         string `json:"roles"`
+	// Permission is the permission the action was allowed by.
+	Permission string `json:"permission"`
+	// Resource is what the action was taken on, e.g. "ad/12".
+	Resource  string    `json:"resource" gorm:"index"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+}
+
+func (AuditRecord) TableName() string {
+	return "t_audit"
+}
+
+// grant is the permission an endpoint call was allowed by. The service
+// marks it privileged when the call depends on it beyond what the caller
+// owns, which makes Authorizer record the call; calls of actions other than
+// user actions are recorded anyway.
+type grant struct {
+	permission string
+	// any is set for ":any" permissions, which extend to resources of
+	// others.
+	any bool
+	// permissions are all the permissions of the caller.
+	permissions map[string]bool
+
+	mu         sync.Mutex
+	privileged bool
+	resources  []string
+}
+
+type grantContextKey struct{}
+
+func grantFromContext(ctx context.Context) (*grant, bool) {
+	g, ok := ctx.Value(grantContextKey{}).(*grant)
+	return g, ok
+}
+
+// covers tells whether the caller holds scope, directly or through "*" or
+// the ":any" permission of the action.
+func (g *grant) covers(scope string) bool {
+	return g.permissions["*"] || g.permissions[scope] || g.permissions[strings.TrimSuffix(scope, ":own")+":any"]
+}
+
+// markPrivileged notes that the call acted on resource through a
+// privileged permission.
+func markPrivileged(ctx context.Context, resource string) {
+	g, ok := grantFromContext(ctx)
+	if !ok {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.privileged = true
+	for _, r := range g.resources {
+		if r == resource {
+			return
+		}
+	}
+	g.resources = append(g.resources, resource)
+}
+
+// Authorizer checks the permissions of callers against a Policy.
+type Authorizer struct {
+	logger log.Logger
+	// record stores audit records.
+	record func([]AuditRecord) error
+	policy Policy
+	// defaultRoles are granted to every authenticated caller.
+	defaultRoles []string
+	// required is set when authentication is enabled. Otherwise anonymous
+	// calls of user actions are let through, as the service does.
+	required bool
+}
+
+func NewAuthorizer(logger log.Logger, db *gorm.DB, policy Policy, defaultRoles []string, required bool) *Authorizer {
+	return &Authorizer{
+		logger: log.With(logger, "component", "Authorizer"),
+		record: func(records []AuditRecord) error {
+			return db.Create(&records).Error
+		},
+		policy:       policy,
+		defaultRoles: defaultRoles,
+		required:     required,
+	}
+}
+
+// permissions returns the permissions the roles of a principal grant, or
+// the scopes of its API key.
+func (a *Authorizer) permissions(principal *Principal) map[string]bool {
+	permissions := map[string]bool{}
+	if principal.IdApiKey != 0 {
+		for _, scope := range principal.Scopes {
+			permissions[scope] = true
+		}
+		return permissions
+	}
+	for _, roles := range [][]string{a.defaultRoles, principal.Roles} {
+		for _, role := range roles {
+			for _, permission := range a.policy[role] {
+				permissions[permission] = true
+			}
+		}
+	}
+	return permissions
+}
+
+// Require is endpoint middleware allowing calls by callers permitted the
+// action. For scoped actions, ":any" is preferred over ":own"; with ":own"
+// only, the service still checks that the caller owns what is acted on.
+// Calls of privileged actions are audited, on the resources the service
+// marked or else on the action itself.
+func (a *Authorizer) Require(action string) endpoint.Middleware {
+	scoped := scopedActions[action]
+	privileged := !userAction(action)
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			principal, ok := PrincipalFromContext(ctx)
+			if !ok {
+				if a.required || privileged {
+					level.Error(a.logger).Log("context", "Require", "msg", ErrUnauthorized, "action", action)
+					return nil, ErrUnauthorized
+				}
+				return next(ctx, request)
+			}
+
+			permissions := a.permissions(principal)
+			g := &grant{permissions: permissions}
+			switch {
+			case permissions["*"]:
+				g.permission, g.any = "*", true
+			case permissions[action+":any"]:
+				g.permission, g.any = action+":any", true
+			case scoped && permissions[action+":own"]:
+				g.permission = action + ":own"
+			case !scoped && permissions[action]:
+				g.permission = action
+			default:
+				level.Error(a.logger).Log("context", "Require", "msg", ErrForbidden, "subject", principal.Subject, "action", action)
+				return nil, ErrForbidden
+			}
+
+			ctx = context.WithValue(ctx, grantContextKey{}, g)
+			response, err := next(ctx, request)
+			if privileged && len(g.resources) == 0 {
+				markPrivileged(ctx, action)
+			}
+			if g.privileged {
+				a.audit(principal, g, response, err)
+			}
+			return response, err
+		}
+	}
+}
+
+func (a *Authorizer) audit(principal *Principal, g *grant, response interface{}, err error) {
+	if e, ok := response.(errorer); ok && err == nil {
+		err = e.error()
+	}
+	roles := append([]string{}, principal.Roles...)
+	sort.Strings(roles)
+	records := []AuditRecord{}
+	for _, resource := range g.resources {
+		record := AuditRecord{
+			Subject:    principal.Subject,
+			Roles:      strings.Join(roles, ","),
+			Permission: g.permission,
+			Resource:   resource,
+		}
+		if err != nil {
+			record.Error = err.Error()
+		}
+		records = append(records, record)
+	}
+	if err := a.record(records); err != nil {
+		level.Error(a.logger).Log("context", "audit", "msg", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"reflect"
+	"testing"
+)
+
+// testAuthorizer returns an Authorizer with DefaultPolicy that keeps the
+// audit records it writes in records.
+func testAuthorizer(required bool, records *[]AuditRecord) *Authorizer {
+	a := NewAuthorizer(log.NewNopLogger(), nil, DefaultPolicy, []string{"user"}, required)
+	a.record = func(r []AuditRecord) error {
+		*records = append(*records, r...)
+		return nil
+	}
+	return a
+}
+
+func TestAuthorizerPolicy(t *testing.T) {
+	user := &Principal{Subject: "u1"}
+	moderator := &Principal{Subject: "m1", Roles: []string{"moderator"}}
+	admin := &Principal{Subject: "a1", Roles: []string{"admin"}}
+	importer := &Principal{Subject: "apikey/1", IdApiKey: 1, Scopes: []string{ActionAdCreate, ActionPhotoWrite + ":any"}}
+
+	actions := []string{ActionAdCreate, ActionAdWrite, ActionAdDelete, ActionPhotoWrite, ActionPhotoDelete,
+		ActionUsageRead, ActionJobRead, ActionJobReplay, ActionAPIKeyManage}
+	for _, tc := range []struct {
+		name      string
+		principal *Principal
+		required  bool
+		// want maps actions to the permission they are granted by, or to
+		// the error they are denied with.
+		want map[string]interface{}
+	}{
+		{"anonymous, authentication disabled", nil, false, map[string]interface{}{
+			ActionAdCreate: "", ActionAdWrite: "", ActionAdDelete: "", ActionPhotoWrite: "", ActionPhotoDelete: "",
+			ActionUsageRead: "", ActionJobRead: ErrUnauthorized, ActionJobReplay: ErrUnauthorized, ActionAPIKeyManage: ErrUnauthorized,
+		}},
+		{"anonymous, authentication enabled", nil, true, map[string]interface{}{
+			ActionAdCreate: ErrUnauthorized, ActionAdWrite: ErrUnauthorized, ActionAdDelete: ErrUnauthorized,
+			ActionPhotoWrite: ErrUnauthorized, ActionPhotoDelete: ErrUnauthorized, ActionUsageRead: ErrUnauthorized,
+			ActionJobRead: ErrUnauthorized, ActionJobReplay: ErrUnauthorized, ActionAPIKeyManage: ErrUnauthorized,
+		}},
+		{"user", user, true, map[string]interface{}{
+			ActionAdCreate: "ad:create", ActionAdWrite: "ad:write:own", ActionAdDelete: "ad:delete:own",
+			ActionPhotoWrite: "photo:write:own", ActionPhotoDelete: "photo:delete:own", ActionUsageRead: "usage:read:own",
+			ActionJobRead: ErrForbidden, ActionJobReplay: ErrForbidden, ActionAPIKeyManage: ErrForbidden,
+		}},
+		{"moderator", moderator, true, map[string]interface{}{
+			ActionAdCreate: "ad:create", ActionAdWrite: "ad:write:any", ActionAdDelete: "ad:delete:any",
+			ActionPhotoWrite: "photo:write:any", ActionPhotoDelete: "photo:delete:any", ActionUsageRead: "usage:read:any",
+			ActionJobRead: "job:read", ActionJobReplay: ErrForbidden, ActionAPIKeyManage: ErrForbidden,
+		}},
+		{"admin", admin, true, map[string]interface{}{
+			ActionAdCreate: "*", ActionAdWrite: "*", ActionAdDelete: "*", ActionPhotoWrite: "*", ActionPhotoDelete: "*",
+			ActionUsageRead: "*", ActionJobRead: "*", ActionJobReplay: "*", ActionAPIKeyManage: "*",
+		}},
+		{"API key", importer, false, map[string]interface{}{
+			ActionAdCreate: "ad:create", ActionAdWrite: ErrForbidden, ActionAdDelete: ErrForbidden,
+			ActionPhotoWrite: "photo:write:any", ActionPhotoDelete: ErrForbidden, ActionUsageRead: ErrForbidden,
+			ActionJobRead: ErrForbidden, ActionJobReplay: ErrForbidden, ActionAPIKeyManage: ErrForbidden,
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var records []AuditRecord
+			a := testAuthorizer(tc.required, &records)
+			ctx := context.Background()
+			if tc.principal != nil {
+				ctx = ContextWithPrincipal(ctx, tc.principal)
+			}
+			for _, action := range actions {
+				var permission string
+				called := false
+				e := a.Require(action)(func(ctx context.Context, request interface{}) (interface{}, error) {
+					called = true
+					if g, ok := grantFromContext(ctx); ok {
+						permission = g.permission
+					}
+					return nil, nil
+				})
+				_, err := e(ctx, nil)
+				switch want := tc.want[action].(type) {
+				case error:
+					if err != want || called {
+						t.Errorf("%s: got %v, called %v, want %v", action, err, called, want)
+					}
+				case string:
+					if err != nil || !called || permission != want {
+						t.Errorf("%s: got %v, called %v, permission %q, want %q", action, err, called, permission, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorizerAudit(t *testing.T) {
+	moderator := &Principal{Subject: "m1", Roles: []string{"user", "moderator"}}
+	admin := &Principal{Subject: "a1", Roles: []string{"admin"}}
+	failure := errors.New("failure")
+
+	for _, tc := range []struct {
+		name      string
+		principal *Principal
+		action    string
+		// marked are the resources the endpoint marks privileged.
+		marked []string
+		err    error
+		want   []AuditRecord
+	}{
+		{"own ad", moderator, ActionAdWrite, nil, nil, nil},
+		{"ad of another user", moderator, ActionAdWrite, []string{"ad/12"}, nil, []AuditRecord{
+			{Subject: "m1", Roles: "moderator,user", Permission: "ad:write:any", Resource: "ad/12"},
+		}},
+		{"photos of another user", moderator, ActionPhotoWrite, []string{"ad/12", "ad/13", "ad/12"}, nil, []AuditRecord{
+			{Subject: "m1", Roles: "moderator,user", Permission: "photo:write:any", Resource: "ad/12"},
+			{Subject: "m1", Roles: "moderator,user", Permission: "photo:write:any", Resource: "ad/13"},
+		}},
+		{"failed call", moderator, ActionAdDelete, []string{"ad/12"}, failure, []AuditRecord{
+			{Subject: "m1", Roles: "moderator,user", Permission: "ad:delete:any", Resource: "ad/12", Error: "failure"},
+		}},
+		{"job listing", moderator, ActionJobRead, nil, nil, []AuditRecord{
+			{Subject: "m1", Roles: "moderator,user", Permission: "job:read", Resource: "job:read"},
+		}},
+		{"job replay", admin, ActionJobReplay, []string{"job/5"}, nil, []AuditRecord{
+			{Subject: "a1", Roles: "admin", Permission: "*", Resource: "job/5"},
+		}},
+		{"API key listing", admin, ActionAPIKeyManage, nil, nil, []AuditRecord{
+			{Subject: "a1", Roles: "admin", Permission: "*", Resource: "apikey:manage"},
+		}},
+		{"denied call", moderator, ActionJobReplay, nil, nil, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var records []AuditRecord
+			a := testAuthorizer(true, &records)
+			e := a.Require(tc.action)(func(ctx context.Context, request interface{}) (interface{}, error) {
+				for _, resource := range tc.marked {
+					markPrivileged(ctx, resource)
+				}
+				return nil, tc.err
+			})
+			e(ContextWithPrincipal(context.Background(), tc.principal), nil)
+			if !reflect.DeepEqual(records, tc.want) {
+				t.Errorf("got %+v, want %+v", records, tc.want)
+			}
+		})
+	}
+}
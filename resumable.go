@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"time"
+)
+
+var (
+	ErrUploadOffset     = errors.New("upload offset does not match")
+	ErrUploadIncomplete = errors.New("upload is incomplete")
+	ErrUploadLength     = errors.New("chunk exceeds the upload length")
+	ErrChunkContentType = errors.New("expected Content-Type application/offset+octet-stream")
+)
+
+// uploadChunkTimeout bounds how long staging a chunk, including receiving
+// it, may take.
+const uploadChunkTimeout = time.Minute * 15
+
+// UploadSession is a resumable upload. Its content is received in chunks,
+// staged in the blob store below uploadChunkPrefix and listed in
+// t_upload_chunk so any instance can take the next one, until the upload is
+// finalized into a photo.
+type UploadSession struct {
+	IdUpload string `json:"id_upload" gorm:"primaryKey"`
+	IdAd     uint   `json:"id_ad" gorm:"index"`
+	Ad       Ad     `json:"-" gorm:"foreignKey:IdAd;constraint:OnDelete:CASCADE"`
+	// Length is the size of the complete upload, Offset how much of it was
+	// received.
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset" gorm:"column:upload_offset"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (UploadSession) TableName() string {
+	return "t_upload"
+}
+
+// UploadChunk is a chunk of an upload, stored as ObjectName.
+type UploadChunk struct {
+	IdUploadChunk uint          `gorm:"primaryKey"`
+	IdUpload      string        `gorm:"index"`
+	Upload        UploadSession `gorm:"foreignKey:IdUpload;constraint:OnDelete:CASCADE"`
+	Offset        int64         `gorm:"column:chunk_offset"`
+	Size          int64
+	ObjectName    string
+}
+
+func (UploadChunk) TableName() string {
+	return "t_upload_chunk"
+}
+
+// uploadChunkObjectName matches the names chunks of resumable uploads are
+// staged under, "resumable/{id}/{nanos}".
+var uploadChunkObjectName = regexp.MustCompile(`^resumable/[0-9a-f]+/[0-9]+$`)
+
+// uploadChunkPrefix returns the prefix of the names the chunks of an upload
+// are staged under, "resumable/{id}/".
+func uploadChunkPrefix(id string) string {
+	return "resumable/" + id + "/"
+}
+
+// chunkReader counts what is read through it. It ends at the first error,
+// which it keeps, so that what arrived before a connection dropped can be
+// stored.
+type chunkReader struct {
+	reader io.Reader
+	n      int64
+	err    error
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	if err != nil && err != io.EOF {
+		r.err, err = err, io.EOF
+	}
+	return n, err
+}
+
+// dropUploads deletes the uploads matching query in tx and queues their
+// staged chunks for deletion. It returns the deletions, to be purged once tx
+// commits, and how many uploads were deleted.
+func dropUploads(tx *gorm.DB, query string, args ...interface{}) ([]BlobDeletion, int64, error) {
+	ids := []string{}
+	result := tx.Model(&UploadSession{}).Clauses(clause.Locking{Strength: "UPDATE"}).Where(query, args...).Pluck("id_upload", &ids)
+	if result.Error != nil || len(ids) == 0 {
+		return nil, 0, result.Error
+	}
+	if result = tx.Delete(&UploadSession{}, "id_upload IN ?", ids); result.Error != nil {
+		return nil, 0, result.Error
+	}
+	deletions := []BlobDeletion{}
+	for _, id := range ids {
+		deletions = append(deletions, BlobDeletion{ObjectName: uploadChunkPrefix(id), Prefix: true, NextAttemptAt: time.Now()})
+	}
+	if err := tx.Create(&deletions).Error; err != nil {
+		return nil, 0, err
+	}
+	return deletions, result.RowsAffected, nil
+}
+
+func newUploadId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (s adService) CreateUpload(ctx context.Context, adId uint, length int64) (*UploadSession, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "CreateUpload request received", "context", fmt.Sprintf("\"id\":%d,\"length\":%d", adId, length))
+
+	if err := s.authorizeAd(ctx, adId); err != nil {
+		level.Error(logger).Log("context", "CreateUpload", "msg", err)
+		return nil, err
+	}
+
+	if length <= 0 {
+		level.Error(logger).Log("context", "CreateUpload", "msg", ErrMissingFields)
+		return nil, ErrMissingFields
+	}
+	if s.limits.MaxBytes > 0 && length > s.limits.MaxBytes {
+		level.Error(logger).Log("context", "CreateUpload", "msg", ErrPhotoTooLarge)
+		return nil, ErrPhotoTooLarge
+	}
+	result := s.db.First(&Ad{}, adId)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		level.Error(logger).Log("context", "CreateUpload", "msg", ErrNotFound)
+		return nil, ErrNotFound
+	}
+	if result.Error != nil {
+		level.Error(logger).Log("context", "CreateUpload", "msg", result.Error)
+		return nil, result.Error
+	}
+	if err := s.checkPhotoQuota(s.db, adId, length); err != nil {
+		level.Error(logger).Log("context", "CreateUpload", "msg", err)
+		return nil, err
+	}
+
+	// Abandoned uploads are dropped as new ones come in.
+	var deletions []BlobDeletion
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		deletions, _, err = dropUploads(tx, "expires_at < ?", time.Now())
+		return err
+	})
+	if err != nil {
+		level.Error(logger).Log("context", "CreateUpload", "msg", err)
+	} else {
+		s.blobPurger.Purge(ctx, deletions)
+	}
+
+	id, err := newUploadId()
+	if err != nil {
+		level.Error(logger).Log("context", "CreateUpload", "msg", err)
+		return nil, err
+	}
+	upload := UploadSession{
+		IdUpload:  id,
+		IdAd:      adId,
+		Length:    length,
+		ExpiresAt: time.Now().Add(s.uploadExpiry),
+	}
+	if result := s.db.Create(&upload); result.Error != nil {
+		level.Error(logger).Log("context", "CreateUpload", "msg", result.Error)
+		return nil, result.Error
+	}
+	return &upload, nil
+}
+
+func (s adService) GetUpload(ctx context.Context, adId uint, id string) (*UploadSession, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "GetUpload request received", "context", fmt.Sprintf("\"id\":%d,\"id_upload\":%q", adId, id))
+
+	if err := s.authorizeAd(ctx, adId); err != nil {
+		level.Error(logger).Log("context", "GetUpload", "msg", err)
+		return nil, err
+	}
+
+	upload, err := s.findUpload(s.db, adId, id)
+	if err != nil {
+		level.Error(logger).Log("context", "GetUpload", "msg", err)
+		return nil, err
+	}
+	return upload, nil
+}
+
+// PatchUpload appends a chunk read from body to an upload. offset must be
+// the upload's current offset, so a chunk is never applied twice.
+func (s adService) PatchUpload(ctx context.Context, adId uint, id string, offset int64, body io.Reader) (*UploadSession, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "PatchUpload request received", "context", fmt.Sprintf("\"id\":%d,\"id_upload\":%q,\"offset\":%d", adId, id, offset))
+
+	if err := s.authorizeAd(ctx, adId); err != nil {
+		level.Error(logger).Log("context", "PatchUpload", "msg", err)
+		return nil, err
+	}
+
+	upload, err := s.findUpload(s.db, adId, id)
+	if err != nil {
+		level.Error(logger).Log("context", "PatchUpload", "msg", err)
+		return nil, err
+	}
+	if offset != upload.Offset {
+		level.Error(logger).Log("context", "PatchUpload", "msg", ErrUploadOffset)
+		return nil, ErrUploadOffset
+	}
+	// The chunk is staged before the upload is locked, which would otherwise
+	// be held for as long as the client takes to send it. A chunk cut short
+	// by a dropped connection is kept, so the client resumes after what
+	// arrived: it is staged apart from the request, whose context ends with
+	// the connection and would abort the write.
+	stageCtx, cancel := context.WithTimeout(context.Background(), uploadChunkTimeout)
+	defer cancel()
+	name := fmt.Sprintf("%s%d", uploadChunkPrefix(id), time.Now().UnixNano())
+	chunk := &chunkReader{reader: io.LimitReader(body, upload.Length-offset+1)}
+	if err := s.blobStore.Put(stageCtx, name, chunk, "application/octet-stream"); err != nil {
+		level.Error(logger).Log("context", "PatchUpload", "msg", err)
+		return nil, ErrUpload
+	}
+	switch {
+	case chunk.n == 0 && chunk.err != nil:
+		level.Error(logger).Log("context", "PatchUpload", "msg", chunk.err)
+		err = ErrUpload
+	case chunk.n > upload.Length-offset:
+		err = ErrUploadLength
+	default:
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			locked, err := s.findUpload(tx.Clauses(clause.Locking{Strength: "UPDATE"}), adId, id)
+			if err != nil {
+				return err
+			}
+			if locked.Offset != offset {
+				return ErrUploadOffset
+			}
+			if chunk.n > 0 {
+				if err := tx.Create(&UploadChunk{IdUpload: id, Offset: offset, Size: chunk.n, ObjectName: name}).Error; err != nil {
+					return err
+				}
+			}
+			upload = locked
+			upload.Offset += chunk.n
+			upload.ExpiresAt = time.Now().Add(s.uploadExpiry)
+			return tx.Model(upload).Updates(map[string]interface{}{"upload_offset": upload.Offset, "expires_at": upload.ExpiresAt}).Error
+		})
+	}
+	if err != nil || chunk.n == 0 {
+		// The staged object is not part of the upload.
+		if err := s.blobStore.Delete(stageCtx, name); err != nil && err != ErrBlobNotFound {
+			level.Error(logger).Log("context", "PatchUpload", "msg", err, "object", name)
+		}
+	}
+	if err != nil {
+		level.Error(logger).Log("context", "PatchUpload", "msg", err)
+		return nil, err
+	}
+	return upload, nil
+}
+
+// FinalizeUpload turns a complete upload into a photo, stored like an upload
+// to PostPhoto, and deletes the upload.
+func (s adService) FinalizeUpload(ctx context.Context, adId uint, id string, onDuplicate string) (*Photo, error) {
+	requestId := fmt.Sprint(time.Now().UnixNano())
+	logger := log.With(s.logger, "request-id", requestId)
+
+	level.Info(logger).Log("msg", "FinalizeUpload request received", "context", fmt.Sprintf("\"id\":%d,\"id_upload\":%q", adId, id))
+
+	if err := s.authorizeAd(ctx, adId); err != nil {
+		level.Error(logger).Log("context", "FinalizeUpload", "msg", err)
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*50)
+	defer cancel()
+
+	upload, err := s.findUpload(s.db, adId, id)
+	if err != nil {
+		level.Error(logger).Log("context", "FinalizeUpload", "msg", err)
+		return nil, err
+	}
+	if upload.Offset < upload.Length {
+		level.Error(logger).Log("context", "FinalizeUpload", "msg", ErrUploadIncomplete)
+		return nil, ErrUploadIncomplete
+	}
+	file, err := s.joinUploadChunks(ctx, id)
+	if err != nil {
+		level.Error(logger).Log("context", "FinalizeUpload", "msg", err)
+		return nil, ErrUpload
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	photo, err := s.storePhoto(ctx, logger, requestId, adId, file, onDuplicate)
+	switch err {
+	case nil, ErrPhotoTooLarge, ErrUnsupportedMediaType, ErrInvalidImage, ErrImageDimensions, ErrDuplicatePhoto:
+		// Failures other than these may succeed when finalized again.
+		var deletions []BlobDeletion
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			deletions, _, err = dropUploads(tx, "id_upload = ?", id)
+			return err
+		})
+		if err != nil {
+			level.Error(logger).Log("context", "FinalizeUpload", "msg", err)
+		} else {
+			s.blobPurger.Purge(ctx, deletions)
+		}
+	}
+	if err != nil {
+		level.Error(logger).Log("context", "FinalizeUpload", "msg", err)
+		return nil, err
+	}
+	return photo, nil
+}
+
+// joinUploadChunks copies the staged chunks of an upload, in order, into a
+// temporary file positioned at its start. The caller closes and removes it.
+func (s adService) joinUploadChunks(ctx context.Context, id string) (*os.File, error) {
+	chunks := []UploadChunk{}
+	if result := s.db.Where("id_upload = ?", id).Order("chunk_offset").Find(&chunks); result.Error != nil {
+		return nil, result.Error
+	}
+	file, err := ioutil.TempFile("", "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	err = func() error {
+		for _, chunk := range chunks {
+			reader, err := s.blobStore.Get(ctx, chunk.ObjectName)
+			if err != nil {
+				return err
+			}
+			n, err := io.Copy(file, reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+			if n != chunk.Size {
+				return fmt.Errorf("chunk %s has %d bytes, not %d", chunk.ObjectName, n, chunk.Size)
+			}
+		}
+		_, err := file.Seek(0, io.SeekStart)
+		return err
+	}()
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s adService) DeleteUpload(ctx context.Context, adId uint, id string) error {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "DeleteUpload request received", "context", fmt.Sprintf("\"id\":%d,\"id_upload\":%q", adId, id))
+
+	if err := s.authorizeAd(ctx, adId); err != nil {
+		level.Error(logger).Log("context", "DeleteUpload", "msg", err)
+		return err
+	}
+
+	var deletions []BlobDeletion
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var deleted int64
+		var err error
+		deletions, deleted, err = dropUploads(tx, "id_ad = ? AND id_upload = ?", adId, id)
+		if err == nil && deleted < 1 {
+			err = ErrNotFound
+		}
+		return err
+	})
+	if err != nil {
+		level.Error(logger).Log("context", "DeleteUpload", "msg", err)
+		return err
+	}
+	s.blobPurger.Purge(ctx, deletions)
+	return nil
+}
+
+// findUpload returns an upload of the ad that has not expired.
+func (s adService) findUpload(db *gorm.DB, adId uint, id string) (*UploadSession, error) {
+	var upload UploadSession
+	result := db.Where("id_ad = ? AND id_upload = ? AND expires_at >= ?", adId, id, time.Now()).First(&upload)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &upload, nil
+}
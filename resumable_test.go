@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChunkReaderKeepsWhatArrived(t *testing.T) {
+	dropped := errors.New("connection reset")
+	chunk := &chunkReader{reader: io.MultiReader(strings.NewReader("first half"), &failingReader{err: dropped})}
+	data, err := ioutil.ReadAll(chunk)
+	if err != nil {
+		t.Fatalf("got %v, want the read to end cleanly", err)
+	}
+	if string(data) != "first half" || chunk.n != int64(len(data)) || chunk.err != dropped {
+		t.Errorf("got %q, n %d, err %v", data, chunk.n, chunk.err)
+	}
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestUploadChunkObjectName(t *testing.T) {
+	name := uploadChunkPrefix("0123456789abcdef0123456789abcdef") + "1700000000000000000"
+	if !uploadChunkObjectName.MatchString(name) {
+		t.Errorf("%s does not match", name)
+	}
+	for _, name := range []string{"resumable/abc/", "resumable/abc/1/2", "upload/1-2", "1-2"} {
+		if uploadChunkObjectName.MatchString(name) {
+			t.Errorf("%s matches", name)
+		}
+	}
+}
+
+// contextBlobStore records the context errors of the calls made to it.
+type contextBlobStore struct {
+	BlobStore
+	errs []error
+}
+
+func (s *contextBlobStore) Put(ctx context.Context, name string, reader io.Reader, contentType string) error {
+	s.errs = append(s.errs, ctx.Err())
+	return s.BlobStore.Put(ctx, name, reader, contentType)
+}
+
+func (s *contextBlobStore) Delete(ctx context.Context, name string) error {
+	s.errs = append(s.errs, ctx.Err())
+	return s.BlobStore.Delete(ctx, name)
+}
+
+func TestPatchUploadOutlivesRequest(t *testing.T) {
+	db := dryRunDB(t)
+	withRows(t, db, UploadSession{IdUpload: "0123456789abcdef", IdAd: 1, Length: 100, ExpiresAt: time.Now().Add(time.Hour)})
+	store := &contextBlobStore{BlobStore: NewMemoryBlobStore("http://cdn.test/photos/")}
+	s := adService{logger: log.NewNopLogger(), db: db, blobStore: store}
+
+	// The client is gone by the time the chunk is staged; the chunk is
+	// then dropped as the upload cannot be updated without a database.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.PatchUpload(ctx, 1, "0123456789abcdef", 0, strings.NewReader("chunk"))
+	if len(store.errs) != 2 {
+		t.Fatalf("got %d blob store calls, want a put and a delete", len(store.errs))
+	}
+	for _, err := range store.errs {
+		if err != nil {
+			t.Errorf("blob store called with a done context: %v", err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+// searchConfig is the text search configuration used for both indexing and
+// querying. "simple" does no stemming, which keeps search predictable for ads
+// written in any language.
+const searchConfig = "simple"
+
+// adSearchVector computes the search_vector column of t_ad from the row's own
+// columns. Title matches weigh more than description matches.
+const adSearchVector = "setweight(to_tsvector('" + searchConfig + "', coalesce(title, '')), 'A') || " +
+	"setweight(to_tsvector('" + searchConfig + "', coalesce(description, '')), 'B')"
+
+// AdSearchQuery describes a full-text search over ad titles and descriptions.
+type AdSearchQuery struct {
+	Q      string `json:"q"`
+	Limit  int    `json:"limit,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// AdSearchHit is an ad matching a search, with its rank and the matching
+// parts of its title and description wrapped in <mark> tags.
+type AdSearchHit struct {
+	Ad                 `gorm:"embedded"`
+	Rank               float32 `json:"rank"`
+	TitleSnippet       string  `json:"title_snippet"`
+	DescriptionSnippet string  `json:"description_snippet"`
+}
+
+// migrateSearch adds the search_vector column and its GIN index to t_ad and
+// fills it in for rows written before the column existed.
+func migrateSearch(db *gorm.DB) error {
+	statements := []string{
+		"ALTER TABLE t_ad ADD COLUMN IF NOT EXISTS search_vector tsvector",
+		"CREATE INDEX IF NOT EXISTS idx_t_ad_search_vector ON t_ad USING GIN (search_vector)",
+		"UPDATE t_ad SET search_vector = " + adSearchVector + " WHERE search_vector IS NULL",
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AfterSave keeps search_vector in sync with the title and description. It
+// runs in the same transaction as the create or update of the ad.
+func (ad *Ad) AfterSave(tx *gorm.DB) error {
+	return tx.Exec("UPDATE t_ad SET search_vector = "+adSearchVector+" WHERE id_ad = ?", ad.IdAd).Error
+}
+
+func (s adService) SearchAds(ctx context.Context, query AdSearchQuery) ([]AdSearchHit, string, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	logContext, _ := json.Marshal(query)
+	level.Info(logger).Log("msg", "SearchAds request received", "context", logContext)
+
+	query.Q = strings.TrimSpace(query.Q)
+	if query.Q == "" {
+		level.Error(logger).Log("context", "SearchAds", "msg", ErrMissingFields)
+		return nil, "", ErrMissingFields
+	}
+	cursor, err := decodePageCursor(query.Cursor, "rank")
+	if err != nil {
+		level.Error(logger).Log("context", "SearchAds", "msg", err)
+		return nil, "", err
+	}
+
+	sql := "SELECT t_ad.*, ts_rank_cd(search_vector, q) AS rank, " +
+		"ts_headline('" + searchConfig + "', title, q, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true') AS title_snippet, " +
+		"ts_headline('" + searchConfig + "', description, q, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=2') AS description_snippet " +
+		"FROM t_ad, websearch_to_tsquery('" + searchConfig + "', ?) AS q " +
+		"WHERE search_vector @@ q"
+	args := []interface{}{query.Q}
+	if cursor != nil {
+		sql += " AND (ts_rank_cd(search_vector, q), id_ad) < (?, ?)"
+		args = append(args, cursor.Rank, cursor.ID)
+	}
+	size := pageSize(query.Limit)
+	sql += " ORDER BY rank DESC, id_ad DESC LIMIT ?"
+	args = append(args, size+1)
+
+	hits := []AdSearchHit{}
+	result := s.db.Raw(sql, args...).Scan(&hits)
+	if result.Error != nil {
+		level.Error(logger).Log("context", "SearchAds", "msg", result.Error)
+		return nil, "", result.Error
+	}
+
+	next := ""
+	if len(hits) > size {
+		hits = hits[:size]
+		last := hits[size-1]
+		next = pageCursor{Sort: "rank", Rank: last.Rank, ID: last.IdAd}.encode()
+	}
+
+	adIds := make([]uint, len(hits))
+	for i, hit := range hits {
+		adIds[i] = hit.IdAd
+	}
+	covers, err := s.coverPhotos(adIds)
+	if err != nil {
+		level.Error(logger).Log("context", "SearchAds", "msg", err)
+		return nil, "", err
+	}
+	for i := range hits {
+		hits[i].Cover = covers[hits[i].IdAd]
+	}
+	return hits, next, nil
+}
@@ -1,8 +1,7 @@
 package main
 
 import (
-	"ad-manager/pb"
-	"cloud.google.com/go/storage"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -10,10 +9,11 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/metadata"
 	"gorm.io/gorm"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
+	"strings"
 	"time"
 )
 
@@ -23,59 +23,405 @@ var (
 	ErrNotFound        = errors.New("not found")
 	ErrMissingFields   = errors.New("missing fields")
 	ErrUpload          = errors.New("upload failed")
+	ErrInvalidQuery    = errors.New("invalid query parameters")
 )
 
 type Service interface {
 	// Ad methiods
+	GetAd(ctx context.Context, id uint) (*Ad, []Photo, error)
+	ListAds(ctx context.Context, query AdQuery) ([]Ad, string, error)
+	SearchAds(ctx context.Context, query AdSearchQuery) ([]AdSearchHit, string, error)
 	PostAd(ctx context.Context, ad Ad) (uint, error)
 	PutAd(ctx context.Context, ad Ad) error
 	DeleteAd(ctx context.Context, id uint) error
 	// Photo methods
-	PostPhoto(ctx context.Context, adId uint, file multipart.File) (*Photo, error)
+	GetPhoto(ctx context.Context, adId uint, id uint) (*Photo, error)
+	// PostPhoto stores a photo. If the ad already has it, onDuplicate, one
+	// of the Duplicate constants, tells what to do.
+	PostPhoto(ctx context.Context, adId uint, file multipart.File, onDuplicate string) (*Photo, error)
+	// PostPhotos stores several photos concurrently. An error is returned
+	// for the batch as a whole; the outcome of each photo is in its result.
+	PostPhotos(ctx context.Context, adId uint, uploads []PhotoUpload, onDuplicate string) ([]PhotoUploadResult, error)
+	// CreateUploadURL issues a URL that a photo of the given content type is
+	// uploaded to directly, bypassing ad-manager. ConfirmUpload then adds it
+	// to the ad.
+	CreateUploadURL(ctx context.Context, adId uint, contentType string) (*UploadURL, error)
+	ConfirmUpload(ctx context.Context, adId uint, objectName string, onDuplicate string) (*Photo, error)
+	// PutSignedUpload receives uploads to URLs ad-manager signed itself, for
+	// storage backends that cannot sign their own.
+	PutSignedUpload(ctx context.Context, upload SignedUpload, body io.Reader) error
+	// CreateUpload starts a resumable upload of length bytes. Its content is
+	// sent in chunks with PatchUpload, then FinalizeUpload adds it to the
+	// ad.
+	CreateUpload(ctx context.Context, adId uint, length int64) (*UploadSession, error)
+	GetUpload(ctx context.Context, adId uint, id string) (*UploadSession, error)
+	PatchUpload(ctx context.Context, adId uint, id string, offset int64, body io.Reader) (*UploadSession, error)
+	FinalizeUpload(ctx context.Context, adId uint, id string, onDuplicate string) (*Photo, error)
+	DeleteUpload(ctx context.Context, adId uint, id string) error
 	DeletePhoto(ctx context.Context, adId uint, id uint) error
+	// ReorderPhotos sets the order of all photos of an ad at once.
+	ReorderPhotos(ctx context.Context, adId uint, photoIds []uint) ([]Photo, error)
+	// SetCoverPhoto makes a photo the only cover photo of its ad.
+	SetCoverPhoto(ctx context.Context, adId uint, id uint) (*Photo, error)
+	// WatchPhoto streams the processing progress of a photo. The channel is
+	// closed once the photo is ready or failed, or ctx is done.
+	WatchPhoto(ctx context.Context, adId uint, id uint) (<-chan PhotoProgress, error)
+	// Health reports the state of the database and the image processor.
+	Health(ctx context.Context) Health
+	// Processing job methods
+	ListProcessingJobs(ctx context.Context, query JobQuery) ([]ProcessingJob, string, error)
+	ReplayProcessingJob(ctx context.Context, id uint) (*ProcessingJob, error)
+	// GetUsage reports what a user stores, and the quotas limiting it.
+	GetUsage(ctx context.Context, idUser string) (*Usage, error)
+	// API key methods. CreateAPIKey and RotateAPIKey return the key itself
+	// along with what is stored of it.
+	CreateAPIKey(ctx context.Context, key APIKey) (*APIKey, string, error)
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	RotateAPIKey(ctx context.Context, id uint) (*APIKey, string, error)
+	RevokeAPIKey(ctx context.Context, id uint) error
+	// AuthenticateAPIKey returns who calls with an API key, or
+	// ErrUnauthorized if the key is invalid.
+	AuthenticateAPIKey(ctx context.Context, key string) (*Principal, error)
 }
 
 type adService struct {
-	logger        log.Logger
-	db            *gorm.DB
-	storageClient *storage.Client
-	grpcConn      *grpc.ClientConn
-	requestId     int64
+	logger     log.Logger
+	db         *gorm.DB
+	blobStore  BlobStore
+	blobPurger *BlobPurger
+	processor  *photoProcessor
+	progress   *progressHub
+	limits     UploadLimits
+	quotas     Quotas
+	allow      MetadataAllowList
+	// requireAuth is ServiceConfig.RequireAuth.
+	requireAuth      bool
+	keyRotationGrace time.Duration
+	// contentAddressed is ServiceConfig.ContentAddressed.
+	contentAddressed bool
+	uploadWorkers    int
+	// uploadSigner is nil if signed uploads are unavailable.
+	uploadSigner    UploadSigner
+	uploadURLExpiry time.Duration
+	uploadExpiry    time.Duration
+	requestId       int64
+}
+
+// ServiceConfig holds the tunables of the service.
+type ServiceConfig struct {
+	// ProcessingWorkers is the number of photos processed concurrently.
+	ProcessingWorkers int
+	// ProcessingMaxAttempts bounds how often processing of a photo is
+	// tried before it is marked failed.
+	ProcessingMaxAttempts int
+	// ProcessorTimeout bounds a call of ImageProcessorService.Process,
+	// ProcessorStreamTimeout one of ProcessStream. ProcessorRetries is how
+	// often a call failing with a transient gRPC code is retried.
+	ProcessorTimeout       time.Duration
+	ProcessorStreamTimeout time.Duration
+	ProcessorRetries       int
+	// UploadLimits bound the photos PostPhoto accepts.
+	UploadLimits UploadLimits
+	// Quotas bound the ads and photos of each user.
+	Quotas Quotas
+	// RequireAuth makes changes to ads and photos require an authenticated
+	// caller, who must own them.
+	RequireAuth bool
+	// APIKeyRotationGrace is how long a rotated API key stays valid.
+	APIKeyRotationGrace time.Duration
+	// UploadWorkers is the number of photos of a batch stored concurrently.
+	UploadWorkers int
+	// MetadataAllowList is the metadata kept in stored photos.
+	MetadataAllowList MetadataAllowList
+	// ContentAddressed names stored photos after their content hash, so
+	// ads with the same photo share its blobs and processing.
+	ContentAddressed bool
+	// UploadURLExpiry is how long upload URLs are valid.
+	UploadURLExpiry time.Duration
+	// UploadExpiry is how long a resumable upload is kept after its last
+	// chunk.
+	UploadExpiry time.Duration
+	// UploadSigningKey and UploadBaseURL let ad-manager sign upload URLs,
+	// pointing to UploadBaseURL, for storage backends that cannot sign their
+	// own.
+	UploadSigningKey string
+	UploadBaseURL    string
+	// StorageBackend and StorageBucket tell the image processor where
+	// originals are stored.
+	StorageBackend string
+	StorageBucket  string
 }
 
 type Ad struct {
 	IdAd        uint      `json:"id_ad" gorm:"primaryKey"`
-	IdUser      string    `json:"id_user"`
+	IdUser      string    `json:"id_user" gorm:"index"`
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
-	Price       float32   `json:"price"`
-	CreatedAt   time.Time `json:"created_at"`
+	Price       float32   `json:"price" gorm:"index"`
+	CreatedAt   time.Time `json:"created_at" gorm:"index"`
 	UpdatedAt   time.Time `json:"updated_at"`
+	// Cover is the ad's cover photo, filled in when ads are read.
+	Cover *Photo `json:"cover,omitempty" gorm:"-"`
 }
 
 func (Ad) TableName() string {
 	return "t_ad"
 }
 
+// AdQuery describes which ads ListAds returns and in what order. Nil and zero
+// valued fields do not filter.
+type AdQuery struct {
+	IdUser        string     `json:"id_user,omitempty"`
+	MinPrice      *float32   `json:"min_price,omitempty"`
+	MaxPrice      *float32   `json:"max_price,omitempty"`
+	CreatedAfter  *time.Time `json:"created_after,omitempty"`
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+	UpdatedAfter  *time.Time `json:"updated_after,omitempty"`
+	UpdatedBefore *time.Time `json:"updated_before,omitempty"`
+	// Sort is one of "created_at" or "price", prefixed with "-" for
+	// descending order. Defaults to "-created_at".
+	Sort   string `json:"sort,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
 type Photo struct {
 	IdPhoto     uint   `json:"id" gorm:"primaryKey"`
 	IdAd        uint   `json:"id_ad"`
 	Ad          Ad     `json:"-" gorm:"foreignKey:IdAd"`
 	UrlOriginal string `json:"url_original"`
+	ObjectName  string `json:"-"`
+	// Status is one of the PhotoStatus constants.
+	Status        string `json:"status" gorm:"not null;default:ready;index"`
+	StatusMessage string `json:"status_message,omitempty"`
+	// ErrorCode is the image processor's pb.ErrorCode name when processing
+	// failed, e.g. "UnsupportedFormat".
+	ErrorCode   string `json:"error_code,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	// Width, Height and Format of the original, read from its header on
+	// upload and updated with what the image processor detected.
+	Width  uint   `json:"width,omitempty"`
+	Height uint   `json:"height,omitempty"`
+	Format string `json:"format,omitempty"`
+	// ContentHash is the hex encoded SHA-256 of the stored original.
+	ContentHash string `json:"content_hash,omitempty"`
+	// Size is the size in bytes of the stored original, which counts
+	// towards Quotas.MaxBytesPerUser.
+	Size int64 `json:"size,omitempty"`
+	// Position orders the photos of an ad, ascending. Cover marks the one
+	// photo shown for the ad; the first photo uploaded is the cover until
+	// another is chosen.
+	Position  int       `json:"position" gorm:"not null;default:0"`
+	Cover     bool      `json:"cover" gorm:"not null;default:false"`
+	CreatedAt time.Time `json:"created_at"`
+	// Variants are the processed renditions of the original.
+	Variants []PhotoVariant `json:"variants" gorm:"foreignKey:IdPhoto"`
+	// Duplicate is set by PostPhoto when it returns a photo the ad already
+	// had.
+	Duplicate bool `json:"-" gorm:"-"`
 }
 
 func (Photo) TableName() string {
 	return "t_photo"
 }
 
-func MakeService(logger log.Logger, db *gorm.DB, storageClient *storage.Client, grpcConn *grpc.ClientConn) Service {
-	db.AutoMigrate(&Ad{}, &Photo{})
-	return &adService{
-		logger:        log.With(logger, "component", "service"),
-		db:            db,
-		storageClient: storageClient,
-		grpcConn:      grpcConn,
+// Names of the variants the image processor produces.
+const (
+	VariantThumbnail = "thumbnail"
+	VariantMedium    = "medium"
+	VariantLarge     = "large"
+	VariantWebP      = "webp"
+)
+
+// PhotoVariant is a processed rendition of a photo, as reported by the image
+// processor.
+type PhotoVariant struct {
+	IdPhotoVariant uint   `json:"-" gorm:"primaryKey"`
+	IdPhoto        uint   `json:"-" gorm:"uniqueIndex:idx_photo_variant_name"`
+	Photo          Photo  `json:"-" gorm:"foreignKey:IdPhoto;constraint:OnDelete:CASCADE"`
+	Name           string `json:"name" gorm:"uniqueIndex:idx_photo_variant_name"`
+	ObjectName     string `json:"-"`
+	Url            string `json:"url"`
+	Width          uint   `json:"width"`
+	Height         uint   `json:"height"`
+	ContentType    string `json:"content_type"`
+}
+
+func (PhotoVariant) TableName() string {
+	return "t_photo_variant"
+}
+
+func MakeService(logger log.Logger, db *gorm.DB, blobStore BlobStore, grpcConn *grpc.ClientConn, config ServiceConfig) Service {
+	db.AutoMigrate(&Ad{}, &Photo{}, &PhotoVariant{}, &BlobDeletion{}, &ProcessingJob{}, &UploadSession{}, &UploadChunk{}, &AuditRecord{}, &APIKey{})
+	if err := migrateSearch(db); err != nil {
+		level.Error(logger).Log("component", "migrateSearch", "msg", err)
+	}
+	// Photos stored before object_name existed only know their URL, which
+	// ends in the object name.
+	db.Exec("UPDATE t_photo SET object_name = regexp_replace(url_original, '^.*/', '') WHERE object_name IS NULL OR object_name = ''")
+	if err := migrateOutbox(db); err != nil {
+		level.Error(logger).Log("component", "migrateOutbox", "msg", err)
+	}
+	if err := migrateDedup(db); err != nil {
+		level.Error(logger).Log("component", "migrateDedup", "msg", err)
+	}
+	if err := migratePhotoOrder(db); err != nil {
+		level.Error(logger).Log("component", "migratePhotoOrder", "msg", err)
+	}
+	if config.UploadWorkers < 1 {
+		config.UploadWorkers = 1
+	}
+	var uploadSigner UploadSigner
+	if signer, ok := blobStore.(UploadSigner); ok {
+		uploadSigner = signer
+	} else if config.UploadSigningKey != "" {
+		uploadSigner = newHMACUploadSigner(config.UploadSigningKey, config.UploadBaseURL)
+	}
+	progress := newProgressHub()
+	service := &adService{
+		logger:           log.With(logger, "component", "service"),
+		db:               db,
+		blobStore:        blobStore,
+		blobPurger:       NewBlobPurger(logger, db, blobStore),
+		processor:        newPhotoProcessor(logger, db, blobStore, grpcConn, progress, config),
+		progress:         progress,
+		limits:           config.UploadLimits,
+		quotas:           config.Quotas,
+		allow:            config.MetadataAllowList,
+		requireAuth:      config.RequireAuth,
+		keyRotationGrace: config.APIKeyRotationGrace,
+		contentAddressed: config.ContentAddressed,
+		uploadWorkers:    config.UploadWorkers,
+		uploadSigner:     uploadSigner,
+		uploadURLExpiry:  config.UploadURLExpiry,
+		uploadExpiry:     config.UploadExpiry,
+	}
+	service.processor.Start(context.Background(), config.ProcessingWorkers)
+	return service
+}
+
+func (s adService) GetAd(ctx context.Context, id uint) (*Ad, []Photo, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "GetAd request received", "context", fmt.Sprintf("\"id\":%d", id))
+
+	var ad Ad
+	result := s.db.First(&ad, id)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		level.Error(logger).Log("context", "GetAd", "msg", ErrNotFound)
+		return nil, nil, ErrNotFound
+	}
+	if result.Error != nil {
+		level.Error(logger).Log("context", "GetAd", "msg", result.Error)
+		return nil, nil, result.Error
+	}
+
+	photos := []Photo{}
+	result = s.db.Preload("Variants").Where("id_ad = ?", id).Order("position, id_photo").Find(&photos)
+	if result.Error != nil {
+		level.Error(logger).Log("context", "GetAd", "msg", result.Error)
+		return nil, nil, result.Error
+	}
+	for i := range photos {
+		if photos[i].Cover {
+			ad.Cover = &photos[i]
+		}
+	}
+	return &ad, photos, nil
+}
+
+func (s adService) ListAds(ctx context.Context, query AdQuery) ([]Ad, string, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	logContext, _ := json.Marshal(query)
+	level.Info(logger).Log("msg", "ListAds request received", "context", logContext)
+
+	if query.Sort == "" {
+		query.Sort = "-created_at"
+	}
+	column, desc := strings.TrimPrefix(query.Sort, "-"), strings.HasPrefix(query.Sort, "-")
+	if column != "created_at" && column != "price" {
+		level.Error(logger).Log("context", "ListAds", "msg", ErrInvalidQuery)
+		return nil, "", ErrInvalidQuery
+	}
+	if query.MinPrice != nil && query.MaxPrice != nil && *query.MinPrice > *query.MaxPrice {
+		level.Error(logger).Log("context", "ListAds", "msg", ErrInvalidQuery)
+		return nil, "", ErrInvalidQuery
+	}
+	cursor, err := decodePageCursor(query.Cursor, query.Sort)
+	if err != nil {
+		level.Error(logger).Log("context", "ListAds", "msg", err)
+		return nil, "", err
+	}
+
+	tx := s.db.Model(&Ad{})
+	if query.IdUser != "" {
+		tx = tx.Where("id_user = ?", query.IdUser)
+	}
+	if query.MinPrice != nil {
+		tx = tx.Where("price >= ?", *query.MinPrice)
+	}
+	if query.MaxPrice != nil {
+		tx = tx.Where("price <= ?", *query.MaxPrice)
+	}
+	if query.CreatedAfter != nil {
+		tx = tx.Where("created_at >= ?", *query.CreatedAfter)
 	}
+	if query.CreatedBefore != nil {
+		tx = tx.Where("created_at < ?", *query.CreatedBefore)
+	}
+	if query.UpdatedAfter != nil {
+		tx = tx.Where("updated_at >= ?", *query.UpdatedAfter)
+	}
+	if query.UpdatedBefore != nil {
+		tx = tx.Where("updated_at < ?", *query.UpdatedBefore)
+	}
+
+	operator, direction := ">", "asc"
+	if desc {
+		operator, direction = "<", "desc"
+	}
+	if cursor != nil {
+		var value interface{} = cursor.Price
+		if column == "created_at" {
+			if cursor.Time == nil {
+				level.Error(logger).Log("context", "ListAds", "msg", ErrInvalidCursor)
+				return nil, "", ErrInvalidCursor
+			}
+			value = *cursor.Time
+		}
+		// Row comparison keeps ads with equal sort keys ordered by id.
+		tx = tx.Where(fmt.Sprintf("(%s, id_ad) %s (?, ?)", column, operator), value, cursor.ID)
+	}
+
+	size := pageSize(query.Limit)
+	ads := []Ad{}
+	result := tx.Order(fmt.Sprintf("%s %s, id_ad %s", column, direction, direction)).Limit(size + 1).Find(&ads)
+	if result.Error != nil {
+		level.Error(logger).Log("context", "ListAds", "msg", result.Error)
+		return nil, "", result.Error
+	}
+
+	next := ""
+	if len(ads) > size {
+		ads = ads[:size]
+		last := ads[size-1]
+		next = pageCursor{Sort: query.Sort, Price: last.Price, Time: &last.CreatedAt, ID: last.IdAd}.encode()
+	}
+
+	adIds := make([]uint, len(ads))
+	for i, ad := range ads {
+		adIds[i] = ad.IdAd
+	}
+	covers, err := s.coverPhotos(adIds)
+	if err != nil {
+		level.Error(logger).Log("context", "ListAds", "msg", err)
+		return nil, "", err
+	}
+	for i := range ads {
+		ads[i].Cover = covers[ads[i].IdAd]
+	}
+	return ads, next, nil
 }
 
 func (s adService) PostAd(ctx context.Context, ad Ad) (uint, error) {
@@ -84,17 +430,39 @@ func (s adService) PostAd(ctx context.Context, ad Ad) (uint, error) {
 	logContext, _ := json.Marshal(ad)
 	level.Info(logger).Log("msg", "PostAd request received", "context", logContext)
 	ad.IdAd = 0
+	// Ads belong to the caller, whatever id_user was sent. Services calling
+	// with an API key granted "ad:create:any", such as importers, add ads on
+	// behalf of users.
+	if principal, ok := PrincipalFromContext(ctx); ok {
+		switch {
+		case principal.IdApiKey == 0 || ad.IdUser == "":
+			ad.IdUser = principal.Subject
+		case ad.IdUser != principal.Subject:
+			if g, ok := grantFromContext(ctx); !ok || !g.any {
+				level.Error(logger).Log("context", "PostAd", "msg", ErrForbidden, "id_user", ad.IdUser)
+				return 0, ErrForbidden
+			}
+			markPrivileged(ctx, "user/"+ad.IdUser)
+		}
+	} else if s.requireAuth {
+		level.Error(logger).Log("context", "PostAd", "msg", ErrUnauthorized)
+		return 0, ErrUnauthorized
+	}
 	if ad.IdUser == "" ||
 		ad.Description == "" ||
 		ad.Title == "" ||
 		ad.Price == 0 {
 		return 0, ErrMissingFields
 	}
-	result := s.db.Create(&ad)
-
-	if result.Error != nil {
-		level.Error(logger).Log("context", "PostAd", "msg", result.Error)
-		return 0, result.Error
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.checkAdQuota(tx, ad.IdUser); err != nil {
+			return err
+		}
+		return tx.Create(&ad).Error
+	})
+	if err != nil {
+		level.Error(logger).Log("context", "PostAd", "msg", err)
+		return 0, err
 	}
 	return ad.IdAd, nil
 }
@@ -110,6 +478,10 @@ func (s adService) PutAd(ctx context.Context, ad Ad) error {
 		level.Error(logger).Log("context", "PutAd", "msg", ErrMissingFields)
 		return ErrMissingFields
 	}
+	if err := s.authorizeAd(ctx, ad.IdAd); err != nil {
+		level.Error(logger).Log("context", "PutAd", "msg", err)
+		return err
+	}
 	result := s.db.Model(&ad).Updates(ad)
 	if result.RowsAffected < 1 {
 		level.Error(logger).Log("context", "PutAd", "msg", ErrNotFound)
@@ -128,20 +500,70 @@ func (s adService) DeleteAd(ctx context.Context, id uint) error {
 
 	level.Info(logger).Log("msg", "DeleteAd request received", "context", fmt.Sprintf("\"id\":%d", id))
 
-	result := s.db.Delete(&Ad{}, id)
-	if result.RowsAffected < 1 {
-		level.Error(logger).Log("context", "DeleteAd", "msg", ErrNotFound)
-		return ErrNotFound
+	if err := s.authorizeAd(ctx, id); err != nil {
+		level.Error(logger).Log("context", "DeleteAd", "msg", err)
+		return err
 	}
 
-	if result.Error != nil {
-		level.Error(logger).Log("context", "DeleteAd", "msg", result.Error)
-		return result.Error
+	// Photos and unfinished uploads go with their ad. Their blobs are queued
+	// for deletion in the same transaction and removed once it commits.
+	deletions := []BlobDeletion{}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		photos := []Photo{}
+		if result := tx.Preload("Variants").Where("id_ad = ?", id).Find(&photos); result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Where("id_ad = ?", id).Delete(&Photo{}); result.Error != nil {
+			return result.Error
+		}
+		uploadDeletions, _, err := dropUploads(tx, "id_ad = ?", id)
+		if err != nil {
+			return err
+		}
+		result := tx.Delete(&Ad{}, id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected < 1 {
+			return ErrNotFound
+		}
+		deletions = photoBlobDeletions(photos)
+		if len(deletions) > 0 {
+			if err := tx.Create(&deletions).Error; err != nil {
+				return err
+			}
+		}
+		deletions = append(deletions, uploadDeletions...)
+		return nil
+	})
+	if err != nil {
+		level.Error(logger).Log("context", "DeleteAd", "msg", err)
+		return err
 	}
+
+	s.blobPurger.Purge(ctx, deletions)
 	return nil
 }
 
-func (s adService) PostPhoto(ctx context.Context, adId uint, file multipart.File) (*Photo, error) {
+func (s adService) GetPhoto(ctx context.Context, adId uint, id uint) (*Photo, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "GetPhoto request received", "context", fmt.Sprintf("\"id\":%d", id))
+
+	var photo Photo
+	result := s.db.Preload("Variants").Where("id_photo = ? AND id_ad = ?", id, adId).First(&photo)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		level.Error(logger).Log("context", "GetPhoto", "msg", ErrNotFound)
+		return nil, ErrNotFound
+	}
+	if result.Error != nil {
+		level.Error(logger).Log("context", "GetPhoto", "msg", result.Error)
+		return nil, result.Error
+	}
+	return &photo, nil
+}
+
+func (s adService) PostPhoto(ctx context.Context, adId uint, file multipart.File, onDuplicate string) (*Photo, error) {
 	requestId := fmt.Sprint(time.Now().UnixNano())
 	logger := log.With(s.logger, "request-id", requestId)
 
@@ -149,60 +571,221 @@ func (s adService) PostPhoto(ctx context.Context, adId uint, file multipart.File
 
 	defer file.Close()
 
+	if err := s.authorizeAd(ctx, adId); err != nil {
+		level.Error(logger).Log("context", "PostPhoto", "msg", err)
+		return nil, err
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, time.Second*50)
 	defer cancel()
 
-	// Upload an object with storage.Writer.
-	bucketName := "meshetr-images"
-	objectName := fmt.Sprintf("%d-%d", adId, time.Now().UnixNano())
-	url := fmt.Sprintf("https://storage.googleapis.com/%s/%s", bucketName, objectName)
-	writer := s.storageClient.Bucket(bucketName).Object(objectName).NewWriter(ctx)
-	if _, err := io.Copy(writer, file); err != nil {
-		level.Error(logger).Log("context", "PostPhoto", "msg", ErrUpload)
+	return s.storePhoto(ctx, logger, requestId, adId, file, onDuplicate)
+}
+
+// storePhoto validates a photo, strips its metadata and stores it, unless
+// the ad already has it.
+func (s adService) storePhoto(ctx context.Context, logger log.Logger, requestId string, adId uint, file io.ReadSeeker, onDuplicate string) (*Photo, error) {
+	info, err := validateUpload(file, s.limits)
+	if err != nil {
+		level.Error(logger).Log("context", "PostPhoto", "msg", err)
+		switch err {
+		case ErrPhotoTooLarge, ErrUnsupportedMediaType, ErrInvalidImage, ErrImageDimensions:
+			return nil, err
+		default:
+			return nil, ErrUpload
+		}
+	}
+
+	// Photos are public, so metadata such as GPS coordinates is removed
+	// before they are stored.
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		level.Error(logger).Log("context", "PostPhoto", "msg", err)
 		return nil, ErrUpload
 	}
-	if err := writer.Close(); err != nil {
+	if data, err = stripMetadata(data, info, s.allow, s.limits.MaxPixels); err != nil {
 		level.Error(logger).Log("context", "PostPhoto", "msg", err)
-		return nil, err
+		if err == ErrInvalidImage || err == ErrImageDimensions {
+			return nil, err
+		}
+		return nil, ErrUpload
 	}
 
-	photo := Photo{IdAd: adId, UrlOriginal: url}
-	result := s.db.Create(&photo)
-	if result.Error != nil {
-		level.Error(logger).Log("context", "PostPhoto", "msg", result.Error)
-		return nil, result.Error
+	// Re-uploads of a photo the ad already has are not stored again.
+	hash := contentHash(data)
+	if existing, err := s.duplicatePhoto(adId, hash, onDuplicate); existing != nil || err != nil {
+		if err != nil {
+			level.Error(logger).Log("context", "PostPhoto", "msg", err)
+		}
+		return existing, err
+	}
+	// Checked again when the photo is created; this spares storing photos
+	// that would be refused.
+	if err := s.checkPhotoQuota(s.db, adId, int64(len(data))); err != nil {
+		level.Error(logger).Log("context", "PostPhoto", "msg", err)
+		return nil, err
 	}
 
-	client := pb.NewImageProcessorServiceClient(s.grpcConn)
-	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
-	ctx = metadata.AppendToOutgoingContext(ctx, "request-id", requestId)
-	defer cancel()
-	status, err := client.Process(ctx, &pb.Image{Id: uint32(photo.IdPhoto)})
+	photo := Photo{
+		IdAd:        adId,
+		ContentType: info.ContentType,
+		Width:       uint(info.Width),
+		Height:      uint(info.Height),
+		Format:      info.Format,
+		ContentHash: hash,
+		Size:        int64(len(data)),
+		Status:      PhotoStatusProcessing,
+	}
+	if s.contentAddressed {
+		err = s.postSharedPhoto(ctx, logger, requestId, &photo, data)
+	} else {
+		err = s.postOwnPhoto(ctx, logger, requestId, &photo, data)
+	}
+	if isUniqueViolation(err) {
+		// The same photo was uploaded concurrently.
+		if existing, dupErr := s.duplicatePhoto(adId, hash, onDuplicate); existing != nil || dupErr != nil {
+			return existing, dupErr
+		}
+	}
 	if err != nil {
 		level.Error(logger).Log("context", "PostPhoto", "msg", err)
 		return nil, err
 	}
-	if status.Code != pb.StatusCode_Ok {
-		level.Error(logger).Log("context", "PostPhoto", "msg", fmt.Sprintf("Received non 200 response code: %d", status.Code))
-		return nil, errors.New(status.Message)
-	}
 
+	if photo.Status != PhotoStatusReady {
+		s.processor.Notify()
+	}
 	return &photo, nil
 }
 
+// postOwnPhoto stores a photo under a name of its own, "{adId}-{nanos}",
+// and queues its processing.
+func (s adService) postOwnPhoto(ctx context.Context, logger log.Logger, requestId string, photo *Photo, data []byte) error {
+	photo.ObjectName = fmt.Sprintf("%d-%d", photo.IdAd, time.Now().UnixNano())
+	if err := s.blobStore.Put(ctx, photo.ObjectName, bytes.NewReader(data), photo.ContentType); err != nil {
+		level.Error(logger).Log("context", "PostPhoto", "msg", err)
+		return ErrUpload
+	}
+	photo.UrlOriginal = s.blobStore.URL(photo.ObjectName)
+
+	// Processing happens in the background; clients follow the photo's
+	// status. The job is queued in the same transaction as the photo.
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.checkPhotoQuota(tx, photo.IdAd, photo.Size); err != nil {
+			return err
+		}
+		if result := tx.Create(photo); result.Error != nil {
+			return result.Error
+		}
+		job := newProcessingJob(*photo, requestId)
+		return tx.Create(&job).Error
+	})
+	if err != nil {
+		if err := s.blobStore.Delete(ctx, photo.ObjectName); err != nil {
+			level.Error(logger).Log("context", "PostPhoto", "msg", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// postSharedPhoto stores a photo under its content-addressed name,
+// "sha256/{hash}", unless a blob of that name exists already. If a photo of
+// another ad shares it and was processed, its variants are reused instead
+// of queueing processing again.
+func (s adService) postSharedPhoto(ctx context.Context, logger log.Logger, requestId string, photo *Photo, data []byte) error {
+	photo.ObjectName = "sha256/" + photo.ContentHash
+	photo.UrlOriginal = s.blobStore.URL(photo.ObjectName)
+	// Other photos may use the blob, so it is left for garbage collection
+	// when this fails.
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockObject(tx, photo.ObjectName); err != nil {
+			return err
+		}
+		if _, err := s.blobStore.Stat(ctx, photo.ObjectName); err == ErrBlobNotFound {
+			if err := s.blobStore.Put(ctx, photo.ObjectName, bytes.NewReader(data), photo.ContentType); err != nil {
+				level.Error(logger).Log("context", "PostPhoto", "msg", err)
+				return ErrUpload
+			}
+		} else if err != nil {
+			level.Error(logger).Log("context", "PostPhoto", "msg", err)
+			return ErrUpload
+		}
+
+		var shared Photo
+		result := tx.Preload("Variants").Where("object_name = ? AND status = ?", photo.ObjectName, PhotoStatusReady).First(&shared)
+		if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return result.Error
+		}
+		if result.Error == nil {
+			photo.Status = PhotoStatusReady
+			photo.Width, photo.Height, photo.Format = shared.Width, shared.Height, shared.Format
+		}
+		if err := s.checkPhotoQuota(tx, photo.IdAd, photo.Size); err != nil {
+			return err
+		}
+		if result := tx.Create(photo); result.Error != nil {
+			return result.Error
+		}
+		if photo.Status != PhotoStatusReady {
+			job := newProcessingJob(*photo, requestId)
+			return tx.Create(&job).Error
+		}
+		photo.Variants = []PhotoVariant{}
+		for _, variant := range shared.Variants {
+			variant.IdPhotoVariant = 0
+			variant.IdPhoto = photo.IdPhoto
+			photo.Variants = append(photo.Variants, variant)
+		}
+		if len(photo.Variants) > 0 {
+			return tx.Create(&photo.Variants).Error
+		}
+		return nil
+	})
+}
+
 func (s adService) DeletePhoto(ctx context.Context, adId uint, id uint) error {
 	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
 
 	level.Info(logger).Log("msg", "DeletePhoto request received", "context", fmt.Sprintf("\"id\":%d", id))
-	result := s.db.Delete(&Photo{IdPhoto: id, IdAd: adId})
-	if result.RowsAffected < 1 {
-		level.Error(logger).Log("context", "DeletePhoto", "msg", ErrNotFound)
-		return ErrNotFound
+
+	if err := s.authorizeAd(ctx, adId); err != nil {
+		level.Error(logger).Log("context", "DeletePhoto", "msg", err)
+		return err
 	}
 
-	if result.Error != nil {
-		level.Error(logger).Log("context", "DeletePhoto", "msg", result.Error)
-		return result.Error
+	deletions := []BlobDeletion{}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockAd(tx, adId); err != nil {
+			return err
+		}
+		var photo Photo
+		result := tx.Preload("Variants").Where("id_photo = ? AND id_ad = ?", id, adId).First(&photo)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Delete(&photo); result.Error != nil {
+			return result.Error
+		}
+		if photo.Cover {
+			if err := promoteCover(tx, adId); err != nil {
+				return err
+			}
+		}
+		deletions = photoBlobDeletions([]Photo{photo})
+		if len(deletions) > 0 {
+			return tx.Create(&deletions).Error
+		}
+		return nil
+	})
+	if err != nil {
+		level.Error(logger).Log("context", "DeletePhoto", "msg", err)
+		return err
 	}
+
+	s.blobPurger.Purge(ctx, deletions)
 	return nil
 }
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"gorm.io/gorm"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSignedUploadUnavailable = errors.New("the storage backend cannot sign upload urls")
+	ErrInvalidSignature        = errors.New("upload url is invalid or expired")
+)
+
+// stagedObjectName matches the names signed uploads are stored under until
+// they are confirmed, "upload/{adId}-{nanos}", and captures the ad id.
+var stagedObjectName = regexp.MustCompile(`^upload/([0-9]+)-[0-9]+$`)
+
+// uploadContentTypes are the content types upload urls are signed for.
+var uploadContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+	"image/heic": true,
+}
+
+// UploadURL tells a client how to upload a photo directly to storage.
+type UploadURL struct {
+	ObjectName string            `json:"object_name"`
+	URL        string            `json:"url"`
+	Method     string            `json:"method"`
+	Headers    map[string]string `json:"headers"`
+	ExpiresAt  time.Time         `json:"expires_at"`
+}
+
+// SignedUpload is the upload of an object to a URL issued by
+// hmacUploadSigner.
+type SignedUpload struct {
+	ObjectName  string
+	ContentType string
+	Expires     int64
+	Signature   string
+}
+
+// hmacUploadSigner signs upload URLs for stores that cannot sign their own,
+// such as "local" and "memory". The URLs point to ad-manager, which checks
+// the signature and stores the upload.
+type hmacUploadSigner struct {
+	key []byte
+	// baseURL is the public URL of the API, e.g.
+	// "https://example.com/manager/api/v1".
+	baseURL string
+}
+
+func newHMACUploadSigner(key string, baseURL string) *hmacUploadSigner {
+	return &hmacUploadSigner{key: []byte(key), baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+func (s *hmacUploadSigner) SignUpload(name string, contentType string, expires time.Time) (string, error) {
+	query := url.Values{
+		"content_type": {contentType},
+		"expires":      {strconv.FormatInt(expires.Unix(), 10)},
+		"signature":    {s.signature(name, contentType, expires.Unix())},
+	}
+	return s.baseURL + "/blob/" + name + "?" + query.Encode(), nil
+}
+
+// Verify checks the signature and expiry of an upload.
+func (s *hmacUploadSigner) Verify(upload SignedUpload) error {
+	expected := s.signature(upload.ObjectName, upload.ContentType, upload.Expires)
+	if !hmac.Equal([]byte(expected), []byte(upload.Signature)) || time.Now().Unix() > upload.Expires {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (s *hmacUploadSigner) signature(name string, contentType string, expires int64) string {
+	mac := hmac.New(sha256.New, s.key)
+	fmt.Fprintf(mac, "PUT\n%s\n%s\n%d", name, contentType, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s adService) CreateUploadURL(ctx context.Context, adId uint, contentType string) (*UploadURL, error) {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "CreateUploadURL request received", "context", fmt.Sprintf("\"id\":%d,\"content_type\":%q", adId, contentType))
+
+	if err := s.authorizeAd(ctx, adId); err != nil {
+		level.Error(logger).Log("context", "CreateUploadURL", "msg", err)
+		return nil, err
+	}
+
+	if s.uploadSigner == nil {
+		level.Error(logger).Log("context", "CreateUploadURL", "msg", ErrSignedUploadUnavailable)
+		return nil, ErrSignedUploadUnavailable
+	}
+	if !uploadContentTypes[contentType] {
+		level.Error(logger).Log("context", "CreateUploadURL", "msg", ErrUnsupportedMediaType)
+		return nil, ErrUnsupportedMediaType
+	}
+	result := s.db.First(&Ad{}, adId)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		level.Error(logger).Log("context", "CreateUploadURL", "msg", ErrNotFound)
+		return nil, ErrNotFound
+	}
+	if result.Error != nil {
+		level.Error(logger).Log("context", "CreateUploadURL", "msg", result.Error)
+		return nil, result.Error
+	}
+	if err := s.checkPhotoQuota(s.db, adId, 0); err != nil {
+		level.Error(logger).Log("context", "CreateUploadURL", "msg", err)
+		return nil, err
+	}
+
+	name := fmt.Sprintf("upload/%d-%d", adId, time.Now().UnixNano())
+	expires := time.Now().Add(s.uploadURLExpiry).Truncate(time.Second)
+	signed, err := s.uploadSigner.SignUpload(name, contentType, expires)
+	if err != nil {
+		level.Error(logger).Log("context", "CreateUploadURL", "msg", err)
+		return nil, ErrSignedUploadUnavailable
+	}
+	return &UploadURL{
+		ObjectName: name,
+		URL:        signed,
+		Method:     "PUT",
+		Headers:    map[string]string{"Content-Type": contentType},
+		ExpiresAt:  expires,
+	}, nil
+}
+
+// ConfirmUpload turns an object uploaded to a signed URL into a photo. It
+// is read back and goes through the checks of PostPhoto, then stored like
+// an upload to PostPhoto; the uploaded object itself is deleted, since the
+// client could still overwrite it until its URL expires. Uploads that are
+// never confirmed are left for garbage collection.
+func (s adService) ConfirmUpload(ctx context.Context, adId uint, objectName string, onDuplicate string) (*Photo, error) {
+	requestId := fmt.Sprint(time.Now().UnixNano())
+	logger := log.With(s.logger, "request-id", requestId)
+
+	level.Info(logger).Log("msg", "ConfirmUpload request received", "context", fmt.Sprintf("\"id\":%d,\"object_name\":%q", adId, objectName))
+
+	if err := s.authorizeAd(ctx, adId); err != nil {
+		level.Error(logger).Log("context", "ConfirmUpload", "msg", err)
+		return nil, err
+	}
+
+	match := stagedObjectName.FindStringSubmatch(objectName)
+	if match == nil || match[1] != strconv.FormatUint(uint64(adId), 10) {
+		level.Error(logger).Log("context", "ConfirmUpload", "msg", ErrInvalidBlobName)
+		return nil, ErrInvalidBlobName
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*50)
+	defer cancel()
+
+	info, err := s.blobStore.Stat(ctx, objectName)
+	if err == ErrBlobNotFound {
+		level.Error(logger).Log("context", "ConfirmUpload", "msg", err)
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		level.Error(logger).Log("context", "ConfirmUpload", "msg", err)
+		return nil, ErrUpload
+	}
+	var photo *Photo
+	if s.limits.MaxBytes > 0 && info.Size > s.limits.MaxBytes {
+		err = ErrPhotoTooLarge
+	} else {
+		var data []byte
+		if data, err = s.readBlob(ctx, objectName); err != nil {
+			level.Error(logger).Log("context", "ConfirmUpload", "msg", err)
+			return nil, ErrUpload
+		}
+		photo, err = s.storePhoto(ctx, logger, requestId, adId, bytes.NewReader(data), onDuplicate)
+	}
+
+	switch err {
+	case nil, ErrPhotoTooLarge, ErrUnsupportedMediaType, ErrInvalidImage, ErrImageDimensions, ErrDuplicatePhoto:
+		// Failures other than these may succeed when confirmed again.
+		if err := s.blobStore.Delete(ctx, objectName); err != nil {
+			level.Error(logger).Log("context", "ConfirmUpload", "msg", err)
+		}
+	}
+	if err != nil {
+		level.Error(logger).Log("context", "ConfirmUpload", "msg", err)
+		return nil, err
+	}
+	return photo, nil
+}
+
+func (s adService) readBlob(ctx context.Context, name string) ([]byte, error) {
+	reader, err := s.blobStore.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// PutSignedUpload stores an upload to a URL issued by hmacUploadSigner.
+func (s adService) PutSignedUpload(ctx context.Context, upload SignedUpload, body io.Reader) error {
+	logger := log.With(s.logger, "request-id", time.Now().UnixNano())
+
+	level.Info(logger).Log("msg", "PutSignedUpload request received", "context", fmt.Sprintf("\"object_name\":%q", upload.ObjectName))
+
+	signer, ok := s.uploadSigner.(*hmacUploadSigner)
+	if !ok {
+		level.Error(logger).Log("context", "PutSignedUpload", "msg", ErrNotFound)
+		return ErrNotFound
+	}
+	if err := signer.Verify(upload); err != nil {
+		level.Error(logger).Log("context", "PutSignedUpload", "msg", err)
+		return err
+	}
+	if !stagedObjectName.MatchString(upload.ObjectName) {
+		level.Error(logger).Log("context", "PutSignedUpload", "msg", ErrInvalidBlobName)
+		return ErrInvalidBlobName
+	}
+
+	if s.limits.MaxBytes > 0 {
+		body = io.LimitReader(body, s.limits.MaxBytes+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		level.Error(logger).Log("context", "PutSignedUpload", "msg", err)
+		return ErrUpload
+	}
+	if s.limits.MaxBytes > 0 && int64(len(data)) > s.limits.MaxBytes {
+		level.Error(logger).Log("context", "PutSignedUpload", "msg", ErrPhotoTooLarge)
+		return ErrPhotoTooLarge
+	}
+	if err := s.blobStore.Put(ctx, upload.ObjectName, bytes.NewReader(data), upload.ContentType); err != nil {
+		level.Error(logger).Log("context", "PutSignedUpload", "msg", err)
+		return ErrUpload
+	}
+	return nil
+}
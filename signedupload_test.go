@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMACUploadSignerVerify(t *testing.T) {
+	signer := newHMACUploadSigner("secret", "https://ads.test/manager/api/v1/")
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	signed, err := signer.SignUpload("upload/1-1", "image/png", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/manager/api/v1/blob/upload/1-1" {
+		t.Errorf("got path %s", u.Path)
+	}
+	valid := SignedUpload{
+		ObjectName:  strings.TrimPrefix(u.Path, "/manager/api/v1/blob/"),
+		ContentType: u.Query().Get("content_type"),
+		Signature:   u.Query().Get("signature"),
+	}
+	if valid.Expires, err = strconv.ParseInt(u.Query().Get("expires"), 10, 64); err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-time.Minute).Unix()
+
+	for _, tc := range []struct {
+		name   string
+		signer *hmacUploadSigner
+		change func(*SignedUpload)
+		valid  bool
+	}{
+		{"valid", signer, func(*SignedUpload) {}, true},
+		{"tampered name", signer, func(u *SignedUpload) { u.ObjectName = "upload/2-1" }, false},
+		{"other content type", signer, func(u *SignedUpload) { u.ContentType = "text/html" }, false},
+		{"later expiry", signer, func(u *SignedUpload) { u.Expires += 3600 }, false},
+		{"expired", signer, func(u *SignedUpload) {
+			u.Expires = expired
+			u.Signature = signer.signature(u.ObjectName, u.ContentType, expired)
+		}, false},
+		{"no signature", signer, func(u *SignedUpload) { u.Signature = "" }, false},
+		{"other key", newHMACUploadSigner("other", "https://ads.test/manager/api/v1"), func(*SignedUpload) {}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upload := valid
+			tc.change(&upload)
+			err := tc.signer.Verify(upload)
+			if tc.valid && err != nil {
+				t.Errorf("got %v, want the upload accepted", err)
+			}
+			if !tc.valid && err != ErrInvalidSignature {
+				t.Errorf("got %v, want ErrInvalidSignature", err)
+			}
+		})
+	}
+}
+
+func TestConfirmUploadObjectName(t *testing.T) {
+	s := adService{logger: log.NewNopLogger(), blobStore: NewMemoryBlobStore("http://cdn.test/photos/")}
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		// Not uploaded, but for ad 1.
+		{"upload/1-1700000000000000000", ErrNotFound},
+		{"upload/2-1700000000000000000", ErrInvalidBlobName},
+		{"upload/12-1700000000000000000", ErrInvalidBlobName},
+		{"upload/01-1700000000000000000", ErrInvalidBlobName},
+		{"upload/1-1700000000000000000/../2-1", ErrInvalidBlobName},
+		{"1-1700000000000000000", ErrInvalidBlobName},
+		{"resumable/abc/1", ErrInvalidBlobName},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := s.ConfirmUpload(context.Background(), 1, tc.name, ""); err != tc.err {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
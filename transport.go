@@ -4,14 +4,18 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/go-kit/kit/transport"
 	httptransport "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var (
@@ -20,10 +24,29 @@ var (
 	ErrBadRouting = errors.New("expected URL variable is missing")
 )
 
-func MakeHTTPHandler(logger log.Logger, s Service) http.Handler {
+// tusRoute names the routes of resumable uploads.
+const tusRoute = "tus"
+
+// tusHeaders is HTTP middleware adding the Tus-Resumable header the tus
+// protocol requires to every response of a resumable upload route, errors
+// included.
+func tusHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() == tusRoute {
+			w.Header().Set("Tus-Resumable", "1.0.0")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MakeHTTPHandler serves the service. Bearer tokens are checked with
+// verifier, or ignored if it is nil, and the permissions of callers with
+// authorizer.
+func MakeHTTPHandler(logger log.Logger, s Service, limits UploadLimits, verifier *jwtVerifier, authorizer *Authorizer) http.Handler {
 	log.With(logger, "component", "HTTPHandler")
 	router := mux.NewRouter().PathPrefix("/manager/api/v1").Subrouter()
-	endpoints := MakeEndpoints(s)
+	endpoints := MakeEndpoints(s, authorizer)
+	router.Use(tusHeaders, authenticate(logger, s, verifier))
 
 	x := true
 	ready := &x
@@ -36,12 +59,60 @@ func MakeHTTPHandler(logger log.Logger, s Service) http.Handler {
 	}
 
 	// Ad endpoints:
+	// GET      /api/v1/ad             list ads, filtered and paginated
+	// GET      /api/v1/ad/search?q=   full-text search over ads
+	// GET      /api/v1/ad/:id         get ad with its photos
 	// POST     /api/v1/ad             add another ad
 	// PUT      /api/v1/ad             post updated ad information about the ad
 	// DELETE   /api/v1/ad/:id         delete ad
 	// Photo endpoints:
-	// POST     /api/v1/photo          add another photo
-	// DELETE   /api/v1/photo/:id      delete photo
+	// GET      /api/v1/ad/:ad-id/photo/:id  get photo with its processing status
+	// POST     /api/v1/ad/:id/photo         add another photo
+	// POST     /api/v1/ad/:id/photos        add several photos at once
+	// POST     /api/v1/ad/:id/photo/upload-url  issue a signed url to upload a photo to
+	// POST     /api/v1/ad/:id/photo/confirm     add a photo uploaded to a signed url
+	// PUT      /api/v1/blob/:name               upload to a url signed by ad-manager
+	// POST     /api/v1/ad/:id/upload                  start a resumable upload
+	// HEAD     /api/v1/ad/:ad-id/upload/:id           get the offset of an upload
+	// PATCH    /api/v1/ad/:ad-id/upload/:id           append a chunk to an upload
+	// POST     /api/v1/ad/:ad-id/upload/:id/finalize  add a complete upload as photo
+	// DELETE   /api/v1/ad/:ad-id/upload/:id           abort an upload
+	// DELETE   /api/v1/ad/:ad-id/photo/:id  delete photo
+	// PUT      /api/v1/ad/:id/photo/order   reorder all photos of an ad
+	// PUT      /api/v1/ad/:ad-id/photo/:id/cover  make photo the ad's cover
+	// GET      /api/v1/ad/:ad-id/photo/:id/progress  server-sent processing events
+	// Processing job endpoints:
+	// GET      /api/v1/job                  list image processing jobs
+	// POST     /api/v1/job/:id/replay       queue a job again
+	// User endpoints:
+	// GET      /api/v1/user/:id/usage       ads, photos and bytes stored, with quotas
+	// API key endpoints:
+	// GET      /api/v1/apikey               list API keys
+	// POST     /api/v1/apikey               create an API key
+	// POST     /api/v1/apikey/:id/rotate    replace an API key with a new one
+	// DELETE   /api/v1/apikey/:id           revoke an API key
+
+	router.Methods("GET").Path("/ad").Handler(httptransport.NewServer(
+		endpoints.ListAdsEndpoint,
+		decodeListAdsRequest,
+		encodeResponse,
+		options...,
+	))
+
+	// Registered before /ad/{id}, which would otherwise match it.
+	router.Methods("GET").Path("/ad/search").Handler(httptransport.NewServer(
+		endpoints.SearchAdsEndpoint,
+		decodeSearchAdsRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("GET").Path("/ad/{id}").Handler(httptransport.NewServer(
+		endpoints.GetAdEndpoint,
+		decodeGetAdRequest,
+		encodeResponse,
+		options...,
+	))
 
 	router.Methods("POST").Path("/ad").Handler(httptransport.NewServer(
 		endpoints.PostAdEndpoint,
@@ -64,9 +135,93 @@ func MakeHTTPHandler(logger log.Logger, s Service) http.Handler {
 		options...,
 	))
 
+	router.Methods("GET").Path("/ad/{ad-id}/photo/{id}").Handler(httptransport.NewServer(
+		endpoints.GetPhotoEndpoint,
+		decodeGetPhotoRequest,
+		encodeResponse,
+		options...,
+	))
+
 	router.Methods("POST").Path("/ad/{id}/photo").Handler(httptransport.NewServer(
 		endpoints.PostPhotoEndpoint,
-		decodePostPhotoRequest,
+		decodePostPhotoRequest(limits.MaxBytes),
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("POST").Path("/ad/{id}/photos").Handler(httptransport.NewServer(
+		endpoints.PostPhotosEndpoint,
+		decodePostPhotosRequest(limits),
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("POST").Path("/ad/{id}/photo/upload-url").Handler(httptransport.NewServer(
+		endpoints.CreateUploadURLEndpoint,
+		decodeCreateUploadURLRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("POST").Path("/ad/{id}/photo/confirm").Handler(httptransport.NewServer(
+		endpoints.ConfirmUploadEndpoint,
+		decodeConfirmUploadRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("PUT").Path("/blob/{name:.+}").Handler(httptransport.NewServer(
+		endpoints.PutSignedUploadEndpoint,
+		decodePutSignedUploadRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("POST").Path("/ad/{id}/upload").Name(tusRoute).Handler(httptransport.NewServer(
+		endpoints.CreateUploadEndpoint,
+		decodeCreateUploadRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("GET", "HEAD").Path("/ad/{ad-id}/upload/{id}").Name(tusRoute).Handler(httptransport.NewServer(
+		endpoints.GetUploadEndpoint,
+		decodeUploadRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("PATCH").Path("/ad/{ad-id}/upload/{id}").Name(tusRoute).Handler(httptransport.NewServer(
+		endpoints.PatchUploadEndpoint,
+		decodePatchUploadRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("POST").Path("/ad/{ad-id}/upload/{id}/finalize").Name(tusRoute).Handler(httptransport.NewServer(
+		endpoints.FinalizeUploadEndpoint,
+		decodeFinalizeUploadRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("DELETE").Path("/ad/{ad-id}/upload/{id}").Name(tusRoute).Handler(httptransport.NewServer(
+		endpoints.DeleteUploadEndpoint,
+		decodeUploadRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("PUT").Path("/ad/{id}/photo/order").Handler(httptransport.NewServer(
+		endpoints.ReorderPhotosEndpoint,
+		decodeReorderPhotosRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("PUT").Path("/ad/{ad-id}/photo/{id}/cover").Handler(httptransport.NewServer(
+		endpoints.SetCoverPhotoEndpoint,
+		decodeSetCoverPhotoRequest,
 		encodeResponse,
 		options...,
 	))
@@ -78,6 +233,62 @@ func MakeHTTPHandler(logger log.Logger, s Service) http.Handler {
 		options...,
 	))
 
+	router.Methods("GET").Path("/ad/{ad-id}/photo/{id}/progress").Handler(httptransport.NewServer(
+		endpoints.WatchPhotoEndpoint,
+		decodeWatchPhotoRequest,
+		encodeProgressStream,
+		options...,
+	))
+
+	router.Methods("GET").Path("/job").Handler(httptransport.NewServer(
+		endpoints.ListProcessingJobsEndpoint,
+		decodeListProcessingJobsRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("POST").Path("/job/{id}/replay").Handler(httptransport.NewServer(
+		endpoints.ReplayProcessingJobEndpoint,
+		decodeReplayProcessingJobRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("GET").Path("/user/{id}/usage").Handler(httptransport.NewServer(
+		endpoints.GetUsageEndpoint,
+		decodeGetUsageRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("GET").Path("/apikey").Handler(httptransport.NewServer(
+		endpoints.ListAPIKeysEndpoint,
+		decodeListAPIKeysRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("POST").Path("/apikey").Handler(httptransport.NewServer(
+		endpoints.CreateAPIKeyEndpoint,
+		decodeCreateAPIKeyRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("POST").Path("/apikey/{id}/rotate").Handler(httptransport.NewServer(
+		endpoints.RotateAPIKeyEndpoint,
+		decodeAPIKeyRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("DELETE").Path("/apikey/{id}").Handler(httptransport.NewServer(
+		endpoints.RevokeAPIKeyEndpoint,
+		decodeAPIKeyRequest,
+		encodeResponse,
+		options...,
+	))
+
 	// health:
 
 	router.Methods("GET").Path("/liveness").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -88,12 +299,21 @@ func MakeHTTPHandler(logger log.Logger, s Service) http.Handler {
 		}
 	})
 
+	// Readiness stays OK while degraded, since uploads are queued until the
+	// image processor is back.
 	router.Methods("GET").Path("/readiness").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if *ready {
-			w.WriteHeader(http.StatusOK)
-		} else {
+		if !*ready {
 			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		health := s.Health(r.Context())
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if health.Status == HealthUnavailable {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
 		}
+		json.NewEncoder(w).Encode(health)
 	})
 
 	router.Methods("GET").Path("/fakekill").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -109,11 +329,73 @@ func MakeHTTPHandler(logger log.Logger, s Service) http.Handler {
 	})
 
 	return handlers.CORS(
-		handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "Accept", "Origin"}),
-		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "HEAD", "OPTIONS"}),
+		handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "Accept", "Origin",
+			"Tus-Resumable", "Upload-Length", "Upload-Offset"}),
+		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}),
+		handlers.ExposedHeaders([]string{"Location", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Expires"}),
 		handlers.AllowedOrigins([]string{"*"}))(router)
 }
 
+func decodeGetAdRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	vars := mux.Vars(requestIn)
+	idInt, _ := strconv.Atoi(vars["id"])
+	id := uint(idInt)
+	if id == 0 {
+		return nil, ErrBadRouting
+	}
+	requestOut := getAdRequest{ID: id}
+	return requestOut, nil
+}
+
+func decodeListAdsRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	values := requestIn.URL.Query()
+	query := AdQuery{
+		IdUser: values.Get("id_user"),
+		Sort:   values.Get("sort"),
+		Cursor: values.Get("cursor"),
+	}
+	var err error
+	if query.MinPrice, err = parseFloatParam(values.Get("min_price")); err != nil {
+		return nil, ErrInvalidQuery
+	}
+	if query.MaxPrice, err = parseFloatParam(values.Get("max_price")); err != nil {
+		return nil, ErrInvalidQuery
+	}
+	if query.CreatedAfter, err = parseTimeParam(values.Get("created_after")); err != nil {
+		return nil, ErrInvalidQuery
+	}
+	if query.CreatedBefore, err = parseTimeParam(values.Get("created_before")); err != nil {
+		return nil, ErrInvalidQuery
+	}
+	if query.UpdatedAfter, err = parseTimeParam(values.Get("updated_after")); err != nil {
+		return nil, ErrInvalidQuery
+	}
+	if query.UpdatedBefore, err = parseTimeParam(values.Get("updated_before")); err != nil {
+		return nil, ErrInvalidQuery
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, ErrInvalidQuery
+		}
+	}
+	return listAdsRequest{Query: query}, nil
+}
+
+func decodeSearchAdsRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	values := requestIn.URL.Query()
+	query := AdSearchQuery{
+		Q:      values.Get("q"),
+		Cursor: values.Get("cursor"),
+	}
+	if limit := values.Get("limit"); limit != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, ErrInvalidQuery
+		}
+	}
+	return searchAdsRequest{Query: query}, nil
+}
+
 func decodePostAdRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
 	var requestOut postAdRequest
 	if e := json.NewDecoder(requestIn.Body).Decode(&requestOut.Ad); e != nil {
@@ -141,26 +423,300 @@ func decodeDeleteAdRequest(ctx context.Context, requestIn *http.Request) (interf
 	return requestOut, nil
 }
 
-func decodePostPhotoRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+func decodeGetPhotoRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
 	vars := mux.Vars(requestIn)
+	adIdInt, _ := strconv.Atoi(vars["ad-id"])
+	adId := uint(adIdInt)
+	if adId == 0 {
+		return nil, ErrBadRouting
+	}
 	idInt, _ := strconv.Atoi(vars["id"])
 	id := uint(idInt)
 	if id == 0 {
 		return nil, ErrBadRouting
 	}
+	requestOut := getPhotoRequest{AdID: adId, ID: id}
+	return requestOut, nil
+}
 
-	defer requestIn.Body.Close()
-	file, _, err := requestIn.FormFile("photo")
-	if err != nil {
+func decodeWatchPhotoRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	vars := mux.Vars(requestIn)
+	adIdInt, _ := strconv.Atoi(vars["ad-id"])
+	adId := uint(adIdInt)
+	if adId == 0 {
+		return nil, ErrBadRouting
+	}
+	idInt, _ := strconv.Atoi(vars["id"])
+	id := uint(idInt)
+	if id == 0 {
+		return nil, ErrBadRouting
+	}
+	requestOut := watchPhotoRequest{AdID: adId, ID: id}
+	return requestOut, nil
+}
+
+// multipartOverhead is what the body of a photo upload may exceed the
+// photo's own size by, for the multipart framing and other fields.
+const multipartOverhead = 1 << 20
+
+// decodePostPhotoRequest refuses bodies larger than maxBytes, plus
+// multipartOverhead, before reading them. PostPhoto checks the size of the
+// photo itself.
+func decodePostPhotoRequest(maxBytes int64) httptransport.DecodeRequestFunc {
+	return func(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+		vars := mux.Vars(requestIn)
+		idInt, _ := strconv.Atoi(vars["id"])
+		id := uint(idInt)
+		if id == 0 {
+			return nil, ErrBadRouting
+		}
+
+		defer requestIn.Body.Close()
+		if maxBytes > 0 {
+			if requestIn.ContentLength > maxBytes+multipartOverhead {
+				return nil, ErrPhotoTooLarge
+			}
+			requestIn.Body = http.MaxBytesReader(nil, requestIn.Body, maxBytes+multipartOverhead)
+		}
+		onDuplicate, err := parseOnDuplicate(requestIn.URL.Query().Get("on_duplicate"))
+		if err != nil {
+			return nil, err
+		}
+		file, _, err := requestIn.FormFile("photo")
+		if err != nil {
+			// MaxBytesReader's error is not exported.
+			if strings.Contains(err.Error(), "request body too large") {
+				return nil, ErrPhotoTooLarge
+			}
+			return nil, ErrMissingFields
+		}
+
+		return postPhotoRequest{
+			AdID:        id,
+			File:        file,
+			OnDuplicate: onDuplicate,
+		}, nil
+	}
+}
+
+// multipartMemory is how much of a multipart body is kept in memory; the
+// rest of the files is spooled to disk.
+const multipartMemory = 32 << 20
+
+// decodePostPhotosRequest opens every "photo" part of the body. The body may
+// hold limits.MaxBatch photos of limits.MaxBytes, plus multipartOverhead.
+// PostPhotos closes the files.
+func decodePostPhotosRequest(limits UploadLimits) httptransport.DecodeRequestFunc {
+	return func(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+		vars := mux.Vars(requestIn)
+		idInt, _ := strconv.Atoi(vars["id"])
+		id := uint(idInt)
+		if id == 0 {
+			return nil, ErrBadRouting
+		}
+
+		defer requestIn.Body.Close()
+		if limits.MaxBytes > 0 && limits.MaxBatch > 0 {
+			maxBody := limits.MaxBytes*int64(limits.MaxBatch) + multipartOverhead
+			if requestIn.ContentLength > maxBody {
+				return nil, ErrPhotoTooLarge
+			}
+			requestIn.Body = http.MaxBytesReader(nil, requestIn.Body, maxBody)
+		}
+		onDuplicate, err := parseOnDuplicate(requestIn.URL.Query().Get("on_duplicate"))
+		if err != nil {
+			return nil, err
+		}
+		if err := requestIn.ParseMultipartForm(multipartMemory); err != nil {
+			if strings.Contains(err.Error(), "request body too large") {
+				return nil, ErrPhotoTooLarge
+			}
+			return nil, ErrMissingFields
+		}
+		headers := requestIn.MultipartForm.File["photo"]
+		if len(headers) == 0 {
+			return nil, ErrMissingFields
+		}
+		if limits.MaxBatch > 0 && len(headers) > limits.MaxBatch {
+			return nil, ErrTooManyPhotos
+		}
+
+		uploads := make([]PhotoUpload, 0, len(headers))
+		for _, header := range headers {
+			file, err := header.Open()
+			if err != nil {
+				for _, upload := range uploads {
+					upload.File.Close()
+				}
+				return nil, err
+			}
+			uploads = append(uploads, PhotoUpload{Name: header.Filename, File: file})
+		}
+		return postPhotosRequest{
+			AdID:        id,
+			Uploads:     uploads,
+			OnDuplicate: onDuplicate,
+		}, nil
+	}
+}
+
+func decodeCreateUploadURLRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	vars := mux.Vars(requestIn)
+	idInt, _ := strconv.Atoi(vars["id"])
+	id := uint(idInt)
+	if id == 0 {
+		return nil, ErrBadRouting
+	}
+	var requestOut createUploadURLRequest
+	if err := json.NewDecoder(requestIn.Body).Decode(&requestOut); err != nil {
+		return nil, err
+	}
+	if requestOut.ContentType == "" {
+		return nil, ErrMissingFields
+	}
+	requestOut.AdID = id
+	return requestOut, nil
+}
+
+func decodeConfirmUploadRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	vars := mux.Vars(requestIn)
+	idInt, _ := strconv.Atoi(vars["id"])
+	id := uint(idInt)
+	if id == 0 {
+		return nil, ErrBadRouting
+	}
+	var requestOut confirmUploadRequest
+	if err := json.NewDecoder(requestIn.Body).Decode(&requestOut); err != nil {
+		return nil, err
+	}
+	if requestOut.ObjectName == "" {
 		return nil, ErrMissingFields
 	}
+	onDuplicate, err := parseOnDuplicate(requestIn.URL.Query().Get("on_duplicate"))
+	if err != nil {
+		return nil, err
+	}
+	requestOut.AdID = id
+	requestOut.OnDuplicate = onDuplicate
+	return requestOut, nil
+}
 
-	return postPhotoRequest{
-		AdID: id,
-		File: file,
+// decodePutSignedUploadRequest leaves the body to be read by the endpoint.
+// The Content-Type must be the one the url was signed for.
+func decodePutSignedUploadRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	vars := mux.Vars(requestIn)
+	name := vars["name"]
+	if name == "" {
+		return nil, ErrBadRouting
+	}
+	values := requestIn.URL.Query()
+	if requestIn.Header.Get("Content-Type") != values.Get("content_type") {
+		return nil, ErrInvalidSignature
+	}
+	expires, err := strconv.ParseInt(values.Get("expires"), 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	return putSignedUploadRequest{
+		Upload: SignedUpload{
+			ObjectName:  name,
+			ContentType: values.Get("content_type"),
+			Expires:     expires,
+			Signature:   values.Get("signature"),
+		},
+		Body: requestIn.Body,
 	}, nil
 }
 
+func decodeCreateUploadRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	vars := mux.Vars(requestIn)
+	idInt, _ := strconv.Atoi(vars["id"])
+	id := uint(idInt)
+	if id == 0 {
+		return nil, ErrBadRouting
+	}
+	length, err := strconv.ParseInt(requestIn.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		return nil, ErrMissingFields
+	}
+	return createUploadRequest{AdID: id, Length: length, Path: requestIn.URL.Path}, nil
+}
+
+func decodeUploadRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	vars := mux.Vars(requestIn)
+	adIdInt, _ := strconv.Atoi(vars["ad-id"])
+	adId := uint(adIdInt)
+	if adId == 0 || vars["id"] == "" {
+		return nil, ErrBadRouting
+	}
+	return uploadRequest{AdID: adId, ID: vars["id"]}, nil
+}
+
+// decodePatchUploadRequest leaves the chunk to be read by the endpoint.
+func decodePatchUploadRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	vars := mux.Vars(requestIn)
+	adIdInt, _ := strconv.Atoi(vars["ad-id"])
+	adId := uint(adIdInt)
+	if adId == 0 || vars["id"] == "" {
+		return nil, ErrBadRouting
+	}
+	if requestIn.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return nil, ErrChunkContentType
+	}
+	offset, err := strconv.ParseInt(requestIn.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return nil, ErrMissingFields
+	}
+	return patchUploadRequest{AdID: adId, ID: vars["id"], Offset: offset, Body: requestIn.Body}, nil
+}
+
+func decodeFinalizeUploadRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	vars := mux.Vars(requestIn)
+	adIdInt, _ := strconv.Atoi(vars["ad-id"])
+	adId := uint(adIdInt)
+	if adId == 0 || vars["id"] == "" {
+		return nil, ErrBadRouting
+	}
+	onDuplicate, err := parseOnDuplicate(requestIn.URL.Query().Get("on_duplicate"))
+	if err != nil {
+		return nil, err
+	}
+	return finalizeUploadRequest{AdID: adId, ID: vars["id"], OnDuplicate: onDuplicate}, nil
+}
+
+func decodeReorderPhotosRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	vars := mux.Vars(requestIn)
+	idInt, _ := strconv.Atoi(vars["id"])
+	id := uint(idInt)
+	if id == 0 {
+		return nil, ErrBadRouting
+	}
+	var requestOut reorderPhotosRequest
+	if err := json.NewDecoder(requestIn.Body).Decode(&requestOut); err != nil {
+		return nil, err
+	}
+	if requestOut.PhotoIDs == nil {
+		return nil, ErrMissingFields
+	}
+	requestOut.AdID = id
+	return requestOut, nil
+}
+
+func decodeSetCoverPhotoRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	vars := mux.Vars(requestIn)
+	adIdInt, _ := strconv.Atoi(vars["ad-id"])
+	adId := uint(adIdInt)
+	if adId == 0 {
+		return nil, ErrBadRouting
+	}
+	idInt, _ := strconv.Atoi(vars["id"])
+	id := uint(idInt)
+	if id == 0 {
+		return nil, ErrBadRouting
+	}
+	return setCoverPhotoRequest{AdID: adId, ID: id}, nil
+}
+
 func decodeDeletePhotoRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
 	vars := mux.Vars(requestIn)
 	adIdInt, _ := strconv.Atoi(vars["ad-id"])
@@ -177,6 +733,108 @@ func decodeDeletePhotoRequest(ctx context.Context, requestIn *http.Request) (int
 	return requestOut, nil
 }
 
+func decodeListProcessingJobsRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	values := requestIn.URL.Query()
+	query := JobQuery{
+		Status: values.Get("status"),
+		Cursor: values.Get("cursor"),
+	}
+	if idPhoto := values.Get("id_photo"); idPhoto != "" {
+		idInt, err := strconv.Atoi(idPhoto)
+		if err != nil || idInt < 0 {
+			return nil, ErrInvalidQuery
+		}
+		query.IdPhoto = uint(idInt)
+	}
+	if limit := values.Get("limit"); limit != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, ErrInvalidQuery
+		}
+	}
+	return listProcessingJobsRequest{Query: query}, nil
+}
+
+func decodeReplayProcessingJobRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	vars := mux.Vars(requestIn)
+	idInt, _ := strconv.Atoi(vars["id"])
+	id := uint(idInt)
+	if id == 0 {
+		return nil, ErrBadRouting
+	}
+	requestOut := replayProcessingJobRequest{ID: id}
+	return requestOut, nil
+}
+
+func decodeGetUsageRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	vars := mux.Vars(requestIn)
+	idUser, ok := vars["id"]
+	if !ok || idUser == "" {
+		return nil, ErrBadRouting
+	}
+	return getUsageRequest{IdUser: idUser}, nil
+}
+
+func decodeListAPIKeysRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	return struct{}{}, nil
+}
+
+func decodeCreateAPIKeyRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	var requestOut createAPIKeyRequest
+	if e := json.NewDecoder(requestIn.Body).Decode(&requestOut.Key); e != nil {
+		return nil, e
+	}
+	return requestOut, nil
+}
+
+func decodeAPIKeyRequest(ctx context.Context, requestIn *http.Request) (interface{}, error) {
+	vars := mux.Vars(requestIn)
+	idInt, _ := strconv.Atoi(vars["id"])
+	id := uint(idInt)
+	if id == 0 {
+		return nil, ErrBadRouting
+	}
+	return apiKeyRequest{ID: id}, nil
+}
+
+// parseOnDuplicate parses the on_duplicate query parameter, defaulting to
+// DuplicateReturn.
+func parseOnDuplicate(value string) (string, error) {
+	switch value {
+	case "":
+		return DuplicateReturn, nil
+	case DuplicateReturn, DuplicateReject:
+		return value, nil
+	default:
+		return "", ErrInvalidQuery
+	}
+}
+
+// parseFloatParam parses an optional numeric query parameter.
+func parseFloatParam(value string) (*float32, error) {
+	if value == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(value, 32)
+	if err != nil {
+		return nil, err
+	}
+	f32 := float32(f)
+	return &f32, nil
+}
+
+// parseTimeParam parses an optional RFC 3339 timestamp query parameter.
+func parseTimeParam(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
 // errorer is implemented by all concrete response types that may contain
 // errors. It allows us to change the HTTP response code without needing to
 // trigger an endpoint (transport-level) error. For more information, read the
@@ -197,14 +855,85 @@ func encodeResponse(ctx context.Context, responseWriter http.ResponseWriter, res
 		return nil
 	}
 	responseWriter.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if headerer, ok := response.(httptransport.Headerer); ok {
+		for key, values := range headerer.Headers() {
+			for _, value := range values {
+				responseWriter.Header().Add(key, value)
+			}
+		}
+	}
+	if statusCoder, ok := response.(httptransport.StatusCoder); ok {
+		code := statusCoder.StatusCode()
+		responseWriter.WriteHeader(code)
+		if code == http.StatusNoContent {
+			return nil
+		}
+	}
 	return json.NewEncoder(responseWriter).Encode(response)
 }
 
+// sseKeepAlive is how often a comment is sent on otherwise idle event
+// streams, so proxies do not time them out.
+const sseKeepAlive = 15 * time.Second
+
+// encodeProgressStream writes the events of a watchPhotoResponse as
+// server-sent events, one per PhotoProgress, named after its Event.
+func encodeProgressStream(ctx context.Context, responseWriter http.ResponseWriter, response interface{}) error {
+	if err, ok := response.(errorer); ok && err.error() != nil {
+		encodeError(ctx, err.error(), responseWriter)
+		return nil
+	}
+	flusher, ok := responseWriter.(http.Flusher)
+	if !ok {
+		return errors.New("streaming not supported")
+	}
+	responseWriter.Header().Set("Content-Type", "text/event-stream")
+	responseWriter.Header().Set("Cache-Control", "no-cache")
+	responseWriter.Header().Set("X-Accel-Buffering", "no")
+	responseWriter.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	events := response.(watchPhotoResponse).Events
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(responseWriter, "event: %s\ndata: %s\n\n", event.Event, data); err != nil {
+				return err
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(responseWriter, ": keep-alive\n\n"); err != nil {
+				return err
+			}
+		}
+		flusher.Flush()
+	}
+}
+
 func encodeError(ctx context.Context, err error, responseWriter http.ResponseWriter) {
 	if err == nil {
 		panic("encodeError with nil error")
 	}
 	responseWriter.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err == ErrUnauthorized {
+		responseWriter.Header().Set("WWW-Authenticate", `Bearer realm="ad-manager"`)
+	}
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) && quotaErr.Kind == QuotaRate {
+		seconds := int64(math.Ceil(quotaErr.RetryAfter.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		responseWriter.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
 	responseWriter.WriteHeader(httpErrCode(err))
 	json.NewEncoder(responseWriter).Encode(map[string]interface{}{
 		"error": err.Error(),
@@ -212,11 +941,32 @@ func encodeError(ctx context.Context, err error, responseWriter http.ResponseWri
 }
 
 func httpErrCode(err error) int {
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		if quotaErr.Kind == QuotaRate {
+			return http.StatusTooManyRequests
+		}
+		return http.StatusForbidden
+	}
 	switch err {
 	case ErrNotFound:
 		return http.StatusNotFound
-	case ErrAlreadyExists, ErrInconsistentIDs, ErrMissingFields, ErrBadRouting:
+	case ErrUnauthorized:
+		return http.StatusUnauthorized
+	case ErrForbidden, ErrInvalidSignature:
+		return http.StatusForbidden
+	case ErrSignedUploadUnavailable:
+		return http.StatusNotImplemented
+	case ErrJobRunning, ErrDuplicatePhoto, ErrUploadOffset, ErrUploadIncomplete:
+		return http.StatusConflict
+	case ErrAlreadyExists, ErrInconsistentIDs, ErrMissingFields, ErrBadRouting, ErrInvalidQuery, ErrInvalidCursor,
+		ErrInvalidImage, ErrImageDimensions, ErrTooManyPhotos, ErrInvalidBlobName,
+		ErrUploadLength, ErrInvalidScope:
 		return http.StatusBadRequest
+	case ErrPhotoTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrUnsupportedMediaType, ErrChunkContentType:
+		return http.StatusUnsupportedMediaType
 	default:
 		return http.StatusInternalServerError
 	}
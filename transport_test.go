@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTusHeaders(t *testing.T) {
+	logger := log.NewNopLogger()
+	s := adService{logger: logger, requireAuth: true}
+	handler := MakeHTTPHandler(logger, s, UploadLimits{}, nil, NewAuthorizer(logger, nil, DefaultPolicy, nil, true))
+
+	for _, tc := range []struct {
+		method, path string
+		code         int
+		tus          bool
+	}{
+		{"POST", "/manager/api/v1/ad/1/upload", http.StatusBadRequest, true},
+		{"HEAD", "/manager/api/v1/ad/1/upload/abc", http.StatusUnauthorized, true},
+		{"PATCH", "/manager/api/v1/ad/1/upload/abc", http.StatusUnsupportedMediaType, true},
+		{"POST", "/manager/api/v1/ad/1/upload/abc/finalize", http.StatusUnauthorized, true},
+		{"DELETE", "/manager/api/v1/ad/1/upload/abc", http.StatusUnauthorized, true},
+		{"POST", "/manager/api/v1/apikey", http.StatusUnauthorized, false},
+	} {
+		request := httptest.NewRequest(tc.method, tc.path, strings.NewReader("{}"))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != tc.code {
+			t.Errorf("%s %s: got %d, want %d", tc.method, tc.path, recorder.Code, tc.code)
+		}
+		if got := recorder.Header().Values("Tus-Resumable"); (len(got) == 1 && got[0] == "1.0.0") != tc.tus {
+			t.Errorf("%s %s: got Tus-Resumable %q", tc.method, tc.path, got)
+		}
+	}
+}
+
+func TestEncodeQuotaError(t *testing.T) {
+	for _, tc := range []struct {
+		err        error
+		code       int
+		retryAfter string
+	}{
+		{&QuotaError{Quota: QuotaPhotosPerAd, Limit: 20}, http.StatusForbidden, ""},
+		{fmt.Errorf("storing photo: %w", &QuotaError{Quota: QuotaBytesPerUser, Limit: 1 << 30}), http.StatusForbidden, ""},
+		{&QuotaError{Quota: QuotaPhotosPerHour, Limit: 10, Kind: QuotaRate, RetryAfter: 90500 * time.Millisecond}, http.StatusTooManyRequests, "91"},
+		{&QuotaError{Quota: QuotaPhotosPerHour, Limit: 10, Kind: QuotaRate}, http.StatusTooManyRequests, "1"},
+	} {
+		recorder := httptest.NewRecorder()
+		encodeError(context.Background(), tc.err, recorder)
+		if recorder.Code != tc.code || recorder.Header().Get("Retry-After") != tc.retryAfter {
+			t.Errorf("%v: got %d with Retry-After %q, want %d with %q", tc.err, recorder.Code, recorder.Header().Get("Retry-After"), tc.code, tc.retryAfter)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+var (
+	ErrPhotoTooLarge        = errors.New("photo exceeds the maximum upload size")
+	ErrUnsupportedMediaType = errors.New("unsupported photo type, expected JPEG, PNG, WebP or HEIC")
+	ErrInvalidImage         = errors.New("photo is not a valid image")
+	ErrImageDimensions      = errors.New("photo dimensions exceed the limits")
+)
+
+// UploadLimits bounds what PostPhoto accepts. Zero values do not limit.
+type UploadLimits struct {
+	MaxBytes  int64
+	MaxWidth  int
+	MaxHeight int
+	// MaxPixels bounds width times height. It guards against decompression
+	// bombs, small files declaring huge images that exhaust memory when
+	// decoded.
+	MaxPixels int64
+	// MaxBatch bounds the photos uploaded in one request.
+	MaxBatch int
+}
+
+// imageInfo is what validateUpload learned about an upload from its header.
+type imageInfo struct {
+	// Format is one of "jpeg", "png", "webp" or "heic".
+	Format      string
+	ContentType string
+	Width       int
+	Height      int
+	Size        int64
+}
+
+// validateUpload sniffs the format of an upload from its content and reads
+// its dimensions from the header, without decoding any pixels, then checks
+// them against limits. The reader is left at the start.
+func validateUpload(file io.ReadSeeker, limits UploadLimits) (*imageInfo, error) {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if limits.MaxBytes > 0 && size > limits.MaxBytes {
+		return nil, ErrPhotoTooLarge
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	// Headers of the supported formats, HEIC's meta box included, are
+	// found within the first few hundred kilobytes.
+	head := make([]byte, 512<<10)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	info := &imageInfo{Size: size}
+	var config image.Config
+	switch {
+	case bytes.HasPrefix(head, []byte("\xff\xd8\xff")):
+		info.Format, info.ContentType = "jpeg", "image/jpeg"
+		config, err = jpeg.DecodeConfig(bytes.NewReader(head))
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		info.Format, info.ContentType = "png", "image/png"
+		config, err = png.DecodeConfig(bytes.NewReader(head))
+	case len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		info.Format, info.ContentType = "webp", "image/webp"
+		config, err = webpConfig(head)
+	case isHEIC(head):
+		info.Format, info.ContentType = "heic", "image/heic"
+		config, err = heicConfig(head)
+	default:
+		return nil, ErrUnsupportedMediaType
+	}
+	if err != nil || config.Width <= 0 || config.Height <= 0 {
+		return nil, ErrInvalidImage
+	}
+	info.Width, info.Height = config.Width, config.Height
+
+	if limits.MaxWidth > 0 && info.Width > limits.MaxWidth ||
+		limits.MaxHeight > 0 && info.Height > limits.MaxHeight ||
+		limits.MaxPixels > 0 && int64(info.Width)*int64(info.Height) > limits.MaxPixels {
+		return nil, ErrImageDimensions
+	}
+	return info, nil
+}
+
+// webpConfig reads the canvas size from the first chunk of a WebP file,
+// which is VP8 for lossy, VP8L for lossless and VP8X for extended files.
+func webpConfig(head []byte) (image.Config, error) {
+	if len(head) < 30 {
+		return image.Config{}, ErrInvalidImage
+	}
+	data := head[20:]
+	switch string(head[12:16]) {
+	case "VP8 ":
+		// A 3 byte frame tag, the start code and 14 bit dimensions.
+		if !bytes.Equal(data[3:6], []byte{0x9d, 0x01, 0x2a}) {
+			return image.Config{}, ErrInvalidImage
+		}
+		return image.Config{
+			Width:  int(binary.LittleEndian.Uint16(data[6:8]) & 0x3fff),
+			Height: int(binary.LittleEndian.Uint16(data[8:10]) & 0x3fff),
+		}, nil
+	case "VP8L":
+		// A signature byte, then width-1 and height-1 in 14 bits each.
+		if data[0] != 0x2f {
+			return image.Config{}, ErrInvalidImage
+		}
+		bits := binary.LittleEndian.Uint32(data[1:5])
+		return image.Config{
+			Width:  int(bits&0x3fff) + 1,
+			Height: int(bits>>14&0x3fff) + 1,
+		}, nil
+	case "VP8X":
+		// Flags and reserved bytes, then width-1 and height-1 in 24 bits
+		// each.
+		return image.Config{
+			Width:  int(uint32(data[4])|uint32(data[5])<<8|uint32(data[6])<<16) + 1,
+			Height: int(uint32(data[7])|uint32(data[8])<<8|uint32(data[9])<<16) + 1,
+		}, nil
+	default:
+		return image.Config{}, ErrInvalidImage
+	}
+}
+
+// heicBrands are the ISO base media file brands of HEIF images.
+var heicBrands = map[string]bool{
+	"heic": true, "heix": true, "heim": true, "heis": true,
+	"hevc": true, "hevx": true, "mif1": true, "msf1": true,
+}
+
+// isHEIC tells whether head starts with the ftyp box of a HEIF image.
+func isHEIC(head []byte) bool {
+	if len(head) < 16 || string(head[4:8]) != "ftyp" {
+		return false
+	}
+	size := int(binary.BigEndian.Uint32(head[0:4]))
+	if size < 16 || size > len(head) {
+		return false
+	}
+	if heicBrands[string(head[8:12])] {
+		return true
+	}
+	for i := 16; i+4 <= size; i += 4 {
+		if heicBrands[string(head[i:i+4])] {
+			return true
+		}
+	}
+	return false
+}
+
+// heicConfig reads the size of a HEIF image from the ispe properties in
+// meta/iprp/ipco. Images list one per item, thumbnails and tiles included,
+// so the largest is the size of the image.
+func heicConfig(head []byte) (image.Config, error) {
+	var config image.Config
+	meta := isoBox(head, "meta")
+	if len(meta) < 4 {
+		return config, ErrInvalidImage
+	}
+	ipco := isoBox(isoBox(meta[4:], "iprp"), "ipco")
+	for ipco != nil {
+		boxType, body, rest := nextISOBox(ipco)
+		if boxType == "ispe" && len(body) >= 12 {
+			width := int(binary.BigEndian.Uint32(body[4:8]))
+			height := int(binary.BigEndian.Uint32(body[8:12]))
+			if width*height > config.Width*config.Height {
+				config.Width, config.Height = width, height
+			}
+		}
+		ipco = rest
+	}
+	if config.Width == 0 {
+		return config, ErrInvalidImage
+	}
+	return config, nil
+}
+
+// isoBox returns the body of the first box of type boxType in data.
+func isoBox(data []byte, boxType string) []byte {
+	for data != nil {
+		t, body, rest := nextISOBox(data)
+		if t == boxType {
+			return body
+		}
+		data = rest
+	}
+	return nil
+}
+
+// nextISOBox splits the first ISO base media box off data, returning its
+// type and body. rest is nil when there is no complete box left.
+func nextISOBox(data []byte) (boxType string, body []byte, rest []byte) {
+	if len(data) < 8 {
+		return "", nil, nil
+	}
+	size := uint64(binary.BigEndian.Uint32(data[0:4]))
+	header := uint64(8)
+	switch size {
+	case 0:
+		size = uint64(len(data))
+	case 1:
+		if len(data) < 16 {
+			return "", nil, nil
+		}
+		size, header = binary.BigEndian.Uint64(data[8:16]), 16
+	}
+	if size < header || size > uint64(len(data)) {
+		return "", nil, nil
+	}
+	return string(data[4:8]), data[header:size], data[size:]
+}